@@ -0,0 +1,256 @@
+package main
+
+import (
+	`encoding/json`
+	`fmt`
+	`mime`
+	`net/http`
+	`time`
+
+	`github.com/tunezaq/gitwServiceChallenge/cache`
+)
+
+type (
+	// apiError is the body of an error response.
+	apiError struct {
+		Error string `json:"error"`
+	}
+
+	// itemMeta is the body of GET /cache/{key}/_meta. Times that aren't
+	// known are left out, and last_read_at is null until the first read.
+	itemMeta struct {
+		Key            cache.Key  `json:"key"`
+		Type           string     `json:"type"`
+		Version        uint64     `json:"version"`
+		CreatedAt      *time.Time `json:"created_at,omitempty"`
+		UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+		LastReadAt     *time.Time `json:"last_read_at"`
+		Reads          int        `json:"reads"`
+		MaxReads       readLimit  `json:"max_reads"`
+		RemainingReads *int       `json:"remaining_reads"` // Null if unlimited.
+		ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+		Size           int64      `json:"size"`
+		Tags           []string   `json:"tags,omitempty"`
+	}
+
+	// incrArg is the optional body of POST /cache/{key}/incr and /decr.
+	incrArg struct {
+		Delta  *float64 `json:"delta"`  // Defaults to 1.
+		Create bool     `json:"create"` // Create a missing key, starting at 0.
+	}
+)
+
+// actions are what POST /cache/{key}/{action} may do.
+var actions = map[string]bool{`incr`: true, `decr`: true, `_meta`: true, `_undelete`: true}
+
+// writeError responds with status and a JSON body saying why.
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	body, _ := json.Marshal(apiError{fmt.Sprintf(format, args...)})
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// one picks the single key an operation on ks acts upon: the only one that
+// exists, or the first (the string, for an untyped URL) if none does. It
+// fails with 409 if more than one exists, since the URL is then ambiguous.
+func one(store cache.Store, ks []cache.Key) (cache.Key, int) {
+	if len(ks) == 0 {
+		return cache.Key{}, 404
+	}
+	var found []cache.Key
+	for _, k := range ks {
+		if _, ret := store.Peek(k); ret == 200 {
+			found = append(found, k)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return ks[0], 200
+	case 1:
+		return found[0], 200
+	}
+	return cache.Key{}, 409
+}
+
+// serveAction serves POST /cache/{key}/{action}, and GET for _meta.
+func serveAction(w http.ResponseWriter, r *http.Request, ns *namespace, ks []cache.Key, action string, body []byte) {
+	method := `POST`
+	if action == `_meta` {
+		method = `GET`
+	}
+	if r.Method != method {
+		writeError(w, 405, `%s only supports %s`, action, method)
+		return
+	}
+	if action == `_undelete` {
+		serveUndelete(w, ns, ks)
+		return
+	}
+	k, ret := one(ns.store, ks)
+	if ret == 404 {
+		writeError(w, 404, `no such key`)
+		return
+	} else if ret == 409 {
+		writeError(w, 409, `key matches items of several types, add ?type=`)
+		return
+	}
+
+	switch action {
+	case `incr`, `decr`:
+		serveIncr(w, r, ns, k, action == `decr`, body)
+	case `_meta`:
+		serveMeta(w, ns, k)
+	}
+}
+
+func serveIncr(w http.ResponseWriter, r *http.Request, ns *namespace, k cache.Key, decr bool, body []byte) {
+	var arg incrArg
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &arg); err != nil {
+			writeError(w, 406, `invalid payload: %v`, err)
+			return
+		}
+	}
+	delta := 1.0
+	if arg.Delta != nil {
+		delta = *arg.Delta
+	}
+	if decr {
+		delta = -delta
+	}
+
+	elt, ret, err := ns.store.Modify(k, cond(r), cache.Incr(delta, arg.Create))
+	switch ret {
+	case 200, 201:
+		w.Header().Set(`ETag`, etag(elt.Version))
+		if ret == 201 {
+			w.Header().Set(`Location`, ns.prefix()+k.URLPath())
+		}
+		body, _ = json.Marshal(elt)
+		w.WriteHeader(ret)
+		w.Write(body)
+	case 404:
+		writeError(w, 404, `no such key, set "create" to create it`)
+	case 412:
+		w.WriteHeader(412)
+	default:
+		writeError(w, ret, `cannot increment: %v`, err)
+	}
+}
+
+// servePatch serves PATCH /cache/{key}: an RFC 7396 merge patch or an RFC
+// 6902 JSON Patch, as the Content-Type says.
+func servePatch(w http.ResponseWriter, r *http.Request, ns *namespace, ks []cache.Key, body []byte) {
+	var fn cache.Modifier
+	ct, _, _ := mime.ParseMediaType(r.Header.Get(`Content-Type`))
+	switch ct {
+	case `application/merge-patch+json`:
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			writeError(w, 406, `invalid merge patch: %v`, err)
+			return
+		}
+		fn = cache.MergePatch(patch)
+	case `application/json-patch+json`:
+		ops, err := cache.ParsePatch(body)
+		if err != nil {
+			writeError(w, 406, `invalid JSON Patch: %v`, err)
+			return
+		}
+		fn = cache.JSONPatch(ops)
+	default:
+		w.Header().Set(`Accept-Patch`, `application/merge-patch+json, application/json-patch+json`)
+		writeError(w, 415, `unsupported patch type %q`, ct)
+		return
+	}
+
+	k, ret := one(ns.store, ks)
+	if ret == 409 {
+		writeError(w, 409, `key matches items of several types, add ?type=`)
+		return
+	}
+	elt, ret, err := ns.store.Modify(k, cond(r), ns.lim.limit(fn))
+	switch ret {
+	case 200:
+		w.Header().Set(`ETag`, etag(elt.Version))
+		w.WriteHeader(204)
+	case 413:
+		writeTooLarge(w, err.(*sizeError))
+	case 404, 412:
+		w.WriteHeader(ret)
+	default:
+		writeError(w, ret, `cannot patch: %v`, err)
+	}
+}
+
+// serveUndelete serves POST /cache/{key}/_undelete, restoring every key in
+// ks that has a tombstone, much as DELETE deletes every one that exists.
+func serveUndelete(w http.ResponseWriter, ns *namespace, ks []cache.Key) {
+	var elts []cacheElt
+	ret := 404
+	for _, k := range ks {
+		elt, r := ns.store.Undelete(k)
+		if r == 201 {
+			elts = append(elts, elt)
+		}
+		if r == 201 || r == 409 && ret == 404 {
+			ret = r
+		}
+	}
+
+	switch ret {
+	case 201:
+		var body []byte
+		if len(elts) == 1 {
+			w.Header().Set(`Location`, ns.prefix()+elts[0].Key.URLPath())
+			w.Header().Set(`ETag`, etag(elts[0].Version))
+			body, _ = json.Marshal(elts)
+		} else {
+			body, _ = json.Marshal(flatCache{Elts: elts})
+		}
+		w.WriteHeader(201)
+		w.Write(body)
+	case 409:
+		writeError(w, 409, `the key is in use again`)
+	default:
+		writeError(w, 404, `nothing to undelete`)
+	}
+}
+
+// timeOrNil returns a pointer to t, or nil if t is zero.
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// serveMeta serves GET /cache/{key}/_meta, which doesn't count as a read.
+func serveMeta(w http.ResponseWriter, ns *namespace, k cache.Key) {
+	info, ret := ns.store.Describe(k)
+	if ret != 200 {
+		writeError(w, ret, `no such key`)
+		return
+	}
+	m := itemMeta{
+		Key:        info.Key,
+		Type:       info.Key.Kind.String(),
+		Version:    info.Version,
+		CreatedAt:  timeOrNil(info.Created),
+		UpdatedAt:  timeOrNil(info.Updated),
+		LastReadAt: timeOrNil(info.Read),
+		Reads:      info.Reads,
+		MaxReads:   readLimit(info.MaxReads),
+		ExpiresAt:  timeOrNil(info.Expires),
+		Size:       info.Size,
+		Tags:       info.Tags,
+	}
+	if info.MaxReads != cache.Unlimited {
+		left := info.MaxReads - info.Reads
+		m.RemainingReads = &left
+	}
+	body, _ := json.Marshal(m)
+	w.Header().Set(`ETag`, etag(info.Version))
+	w.Write(body)
+}
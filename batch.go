@@ -0,0 +1,169 @@
+package main
+
+import (
+	`encoding/json`
+	`fmt`
+	`net/http`
+
+	`github.com/tunezaq/gitwServiceChallenge/cache`
+)
+
+// POST /cache/_batch and /cache/_txn run a batch or a transaction rather
+// than creating anything.
+const (
+	batchKey = `_batch`
+	txnKey   = `_txn`
+)
+
+type (
+	// batchOp is one operation of a batch: the POST/PUT contract plus what
+	// to do with it.
+	batchOp struct {
+		Op string `json:"op"`
+		cacheArg
+	}
+
+	// txnCheck is a precondition of a transaction. An item must exist,
+	// unless exists is false, and have the value and version given.
+	txnCheck struct {
+		Key     cache.Key       `json:"key"`
+		Exists  *bool           `json:"exists"`
+		Value   json.RawMessage `json:"value"`
+		Version *uint64         `json:"version"`
+	}
+
+	// txnArg is the body of POST /cache/_txn: checks, and operations run
+	// atomically if all of them hold.
+	txnArg struct {
+		If   []txnCheck `json:"if"`
+		Then []batchOp  `json:"then"`
+	}
+
+	// batchResult reports how an operation went. Value is only set by get.
+	batchResult struct {
+		Status  int         `json:"status"`
+		Key     cache.Key   `json:"key"`
+		Version uint64      `json:"version,omitempty"`
+		Value   interface{} `json:"value,omitempty"`
+	}
+
+	// batchReply is the response to a batch or transaction. Failed lists
+	// the checks of a transaction that didn't hold.
+	batchReply struct {
+		Failed  []int         `json:"failed,omitempty"`
+		Results []batchResult `json:"results"`
+	}
+)
+
+func parseOps(bops []batchOp, lim limits) ([]cache.Op, error) {
+	ops := make([]cache.Op, len(bops))
+	for i, bop := range bops {
+		switch bop.Op {
+		case cache.OpCreate, cache.OpUpdate, cache.OpUpsert, cache.OpDelete, cache.OpGet:
+		default:
+			return nil, fmt.Errorf(`operation %d: unknown op %q`, i, bop.Op)
+		}
+		if err := bop.check(); err != nil {
+			return nil, fmt.Errorf(`operation %d: %v`, i, err)
+		}
+		if err := lim.check(bop.Key, bop.Value); err != nil {
+			err.what = fmt.Sprintf(`operation %d: %s`, i, err.what)
+			return nil, err
+		}
+		ops[i] = cache.Op{Op: bop.Op, Key: bop.Key, Value: bop.Value, Meta: bop.meta()}
+	}
+	return ops, nil
+}
+
+func parseChecks(tcs []txnCheck) ([]cache.Check, error) {
+	checks := make([]cache.Check, len(tcs))
+	for i, tc := range tcs {
+		c := cache.Check{Key: tc.Key, Exists: tc.Exists == nil || *tc.Exists}
+		if c.Key.IsZero() {
+			return nil, fmt.Errorf(`check %d: missing key`, i)
+		}
+		if tc.Value != nil {
+			if err := json.Unmarshal(tc.Value, &c.Value); err != nil {
+				return nil, fmt.Errorf(`check %d: %v`, i, err)
+			}
+			c.HasValue = true
+		}
+		if tc.Version != nil {
+			if *tc.Version == cache.Any {
+				return nil, fmt.Errorf(`check %d: versions start at 1`, i)
+			}
+			c.Version = *tc.Version
+		}
+		if !c.Exists && (c.HasValue || c.Version != cache.Any) {
+			return nil, fmt.Errorf(`check %d: a missing item has no value or version`, i)
+		}
+		checks[i] = c
+	}
+	return checks, nil
+}
+
+// reply writes the results of a batch or transaction: 200, or 409 if
+// anything failed and nothing was done.
+func reply(w http.ResponseWriter, failed []int, res []cache.Result, atomic bool) {
+	ret := 200
+	if failed != nil {
+		ret = 409
+	}
+	results := make([]batchResult, len(res))
+	for i, r := range res {
+		results[i] = batchResult{r.Status, r.Elt.Key, r.Elt.Version, r.Elt.Value}
+		if atomic && r.Status >= 300 {
+			ret = 409
+		}
+	}
+	body, _ := json.Marshal(batchReply{failed, results})
+	w.WriteHeader(ret)
+	w.Write(body)
+}
+
+// serveBatch serves POST /cache/_batch.
+func serveBatch(w http.ResponseWriter, r *http.Request, ns *namespace, body []byte) {
+	atomic, err := flagParam(r, `atomic`)
+	if err != nil {
+		writeError(w, 406, `invalid atomic: %v`, err)
+		return
+	}
+	var bops []batchOp
+	if err = json.Unmarshal(body, &bops); err != nil {
+		writeError(w, 406, `invalid batch: %v`, err)
+		return
+	}
+	ops, err := parseOps(bops, ns.lim)
+	if err, ok := err.(*sizeError); ok {
+		writeTooLarge(w, err)
+		return
+	} else if err != nil {
+		writeError(w, 406, `invalid batch: %v`, err)
+		return
+	}
+	reply(w, nil, ns.store.Batch(ops, atomic), atomic)
+}
+
+// serveTxn serves POST /cache/_txn.
+func serveTxn(w http.ResponseWriter, r *http.Request, ns *namespace, body []byte) {
+	var arg txnArg
+	if err := json.Unmarshal(body, &arg); err != nil {
+		writeError(w, 406, `invalid transaction: %v`, err)
+		return
+	}
+	checks, err := parseChecks(arg.If)
+	if err != nil {
+		writeError(w, 406, `invalid transaction: %v`, err)
+		return
+	}
+	ops, err := parseOps(arg.Then, ns.lim)
+	if err, ok := err.(*sizeError); ok {
+		writeTooLarge(w, err)
+		return
+	} else if err != nil {
+		writeError(w, 406, `invalid transaction: %v`, err)
+		return
+	}
+	failed, res := ns.store.Txn(checks, ops)
+	reply(w, failed, res, true)
+}
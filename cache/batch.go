@@ -0,0 +1,164 @@
+package cache
+
+import (
+	`reflect`
+	`sort`
+)
+
+// Batch operations.
+const (
+	OpCreate = `create`
+	OpUpdate = `update`
+	OpUpsert = `upsert`
+	OpDelete = `delete`
+	OpGet    = `get`
+)
+
+func (s *Sharded) Batch(ops []Op, atomic bool) []Result {
+	if atomic {
+		_, res := s.Txn(nil, ops)
+		return res
+	}
+	res := make([]Result, len(ops))
+	for i, op := range ops {
+		sh := s.shardFor(op.Key)
+		sh.Lock()
+		res[i] = s.run(sh, op)
+		sh.Unlock()
+		s.evict()
+	}
+	return res
+}
+
+func (s *Sharded) Txn(checks []Check, ops []Op) ([]int, []Result) {
+	defer s.evict()
+	keys := make([]Key, 0, len(checks)+len(ops))
+	for _, c := range checks {
+		keys = append(keys, c.Key)
+	}
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+	}
+	defer s.unlock(s.lock(keys))
+
+	now := s.now()
+	var failed []int
+	for i, c := range checks {
+		if !c.holds(s.shardFor(c.Key).lookup(c.Key, now)) {
+			failed = append(failed, i)
+		}
+	}
+	res := make([]Result, len(ops))
+	if failed != nil {
+		for i, op := range ops {
+			res[i] = Result{424, Elt{Key: op.Key}}
+		}
+		return failed, res
+	}
+
+	// Remember every item as it was before the first op touched it, and
+	// its tombstone, nil if missing, to put them back should an op fail.
+	type saved struct {
+		e *entry
+		g *grave
+	}
+	orig := make(map[Key]saved)
+	succeeded := true
+	for i, op := range ops {
+		sh := s.shardFor(op.Key)
+		if _, ok := orig[op.Key]; !ok {
+			o := saved{g: sh.dead[op.Key]}
+			if e := sh.lookup(op.Key, now); e != nil {
+				c := *e
+				o.e = &c
+			}
+			orig[op.Key] = o
+		}
+		res[i] = s.run(sh, op)
+		succeeded = succeeded && res[i].Status < 300
+	}
+	if succeeded {
+		return nil, res
+	}
+
+	for k, o := range orig {
+		sh := s.shardFor(k)
+		if e, ok := sh.items[k]; ok {
+			sh.remove(k, e)
+		}
+		if o.e != nil {
+			sh.add(k, o.e)
+		}
+		if o.g != nil {
+			sh.keep(k, o.g)
+		} else {
+			sh.forget(k)
+		}
+	}
+	for i := range res {
+		if res[i].Status < 300 {
+			res[i] = Result{424, Elt{Key: res[i].Elt.Key}}
+		}
+	}
+	return nil, res
+}
+
+func (c Check) holds(e *entry) bool {
+	if e == nil {
+		return !c.Exists
+	}
+	return c.Exists &&
+		(!c.HasValue || reflect.DeepEqual(e.value(), c.Value)) &&
+		(c.Version == Any || c.Version == e.Version)
+}
+
+// lock locks the shards owning keys, in index order so that concurrent
+// transactions can't deadlock.
+func (s *Sharded) lock(keys []Key) []*shard {
+	idx := make(map[int]bool)
+	for _, k := range keys {
+		idx[s.shardIndex(k)] = true
+	}
+	order := make([]int, 0, len(idx))
+	for i := range idx {
+		order = append(order, i)
+	}
+	sort.Ints(order)
+	shards := make([]*shard, len(order))
+	for j, i := range order {
+		shards[j] = s.shards[i]
+		shards[j].Lock()
+	}
+	for _, sh := range shards {
+		sh.preserve()
+	}
+	return shards
+}
+
+// unlock lets go of shards locked by lock, then journals what changed.
+func (s *Sharded) unlock(shards []*shard) {
+	s.log.commit(s.release(shards))
+}
+
+// run carries out op on sh, the locked shard owning its key.
+func (s *Sharded) run(sh *shard, op Op) Result {
+	k := op.Key
+	switch op.Op {
+	case OpCreate:
+		v, ret := s.create(sh, k, op.Value, op.Meta)
+		return Result{ret, Elt{Key: k, Version: v}}
+	case OpUpdate:
+		v, ret := s.update(sh, k, op.Value, op.Meta, Cond{})
+		return Result{ret, Elt{Key: k, Version: v}}
+	case OpUpsert:
+		v, ret := s.upsert(sh, k, op.Value, op.Meta, Cond{})
+		return Result{ret, Elt{Key: k, Version: v}}
+	case OpDelete:
+		return Result{s.delete(sh, k, Cond{}), Elt{Key: k}}
+	case OpGet:
+		elt, ret := s.get(sh, k)
+		elt.Key = k
+		return Result{ret, elt}
+	}
+	return Result{406, Elt{Key: k}}
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	`bytes`
+	`compress/flate`
+	`encoding/gob`
+	`encoding/json`
+	`io/ioutil`
+)
+
+// packed is a value held compressed: its JSON, deflated. Values are only
+// unpacked when read, so a store holding mostly large, repetitive values
+// trades CPU on every read and write for memory and snapshot size.
+type packed struct {
+	Data []byte
+	Raw  int64 // Length of the JSON.
+}
+
+func init() {
+	gob.Register(packed{})
+}
+
+// pack compresses v if its JSON is at least threshold bytes long and
+// deflating it actually saves space. A zero threshold turns compression
+// off, unpacking v if it was packed before, as when loading a snapshot.
+func pack(v interface{}, threshold int64) interface{} {
+	if p, ok := v.(packed); ok {
+		if threshold > 0 && p.Raw >= threshold {
+			return p
+		}
+		v = unpack(p)
+	}
+	if threshold <= 0 {
+		return v
+	}
+	raw, err := json.Marshal(v)
+	if err != nil || int64(len(raw)) < threshold {
+		return v
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(raw)
+	w.Close()
+	if buf.Len() >= len(raw) {
+		return v
+	}
+	return packed{buf.Bytes(), int64(len(raw))}
+}
+
+// unpack returns v as stored, decompressing it if it was packed.
+func unpack(v interface{}) interface{} {
+	p, ok := v.(packed)
+	if !ok {
+		return v
+	}
+	// The data is what pack made of a JSON value, so it always decodes.
+	raw, _ := ioutil.ReadAll(flate.NewReader(bytes.NewReader(p.Data)))
+	var u interface{}
+	json.Unmarshal(raw, &u)
+	return u
+}
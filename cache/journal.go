@@ -0,0 +1,343 @@
+package cache
+
+import (
+	`bytes`
+	`encoding/binary`
+	`encoding/gob`
+	`fmt`
+	`hash/crc32`
+	`io`
+	`sync`
+	`sync/atomic`
+	`time`
+)
+
+type (
+	// journal is where a store records its changes once Journal is
+	// called. Shards queue records, under their own lock, as they unlock,
+	// and commit them once unlocked: whoever commits first writes what
+	// everyone queued meanwhile, so shards never wait on each other's
+	// writes, and concurrent changes share a Write (and a sync, if w
+	// syncs on every Write).
+	journal struct {
+		sync.Mutex // Guards on, queue and queued.
+		on         bool
+		queue      []record
+		queued     uint64 // Records ever queued.
+
+		// Held while writing; guards the rest.
+		wmu     sync.Mutex
+		written uint64 // Records ever taken off the queue.
+		w       io.Writer
+		enc     *gob.Encoder
+		buf     bytes.Buffer // What enc encodes, to write in one go.
+		// Once a write fails, w may end in part of a record, so nothing
+		// more is written to it. Instead, these note the keys whose
+		// changes it misses, and whether it misses a Clear, for the next
+		// call to Journal to record anew.
+		lost    map[Key]bool
+		cleared bool
+	}
+
+	recOp uint8
+
+	// record is one change to a store, as Replay reads it back. Records
+	// carry the state a key was left in rather than the operation, so
+	// replaying one that a snapshot already reflects does no harm.
+	record struct {
+		Op  recOp
+		Key Key
+		// The item, for recPut.
+		Entry *entry
+		// The item's tombstone, if any, for recPut and recDrop.
+		Grave *grave
+		// The read count and time, for recRead.
+		Reads int
+		Read  time.Time
+	}
+)
+
+// Each Write holds a batch of records behind a header: the length of the
+// batch and its CRC-32, both big-endian uint32s.
+const batchHeader = 8
+
+const (
+	recPut   recOp = iota + 1 // The item was created or changed.
+	recDrop                   // The item is gone.
+	recRead                   // The item was read.
+	recClear                  // Every item is gone.
+)
+
+// add queues r, returning the sequence number to commit, or 0 when not
+// journaling. j must be locked.
+func (j *journal) add(r record) uint64 {
+	if !j.on {
+		return 0
+	}
+	j.queue = append(j.queue, r)
+	j.queued++
+	return j.queued
+}
+
+// commit returns once the records queued up to seq are written.
+func (j *journal) commit(seq uint64) {
+	if seq == 0 {
+		return
+	}
+	j.wmu.Lock()
+	defer j.wmu.Unlock()
+	if j.written >= seq {
+		return
+	}
+	j.Lock()
+	recs := j.queue
+	j.queue, j.written = nil, j.queued
+	j.Unlock()
+	j.put(recs)
+}
+
+// put writes recs, or notes them as lost. j.wmu must be held.
+func (j *journal) put(recs []record) {
+	if j.w == nil {
+		return
+	}
+	if j.lost == nil {
+		// The batch goes behind a header giving its length and checksum,
+		// so that Replay can tell it has all of it.
+		j.buf.Reset()
+		j.buf.Write(make([]byte, batchHeader))
+		var err error
+		for _, r := range recs {
+			if err = j.enc.Encode(r); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			b := j.buf.Bytes()
+			binary.BigEndian.PutUint32(b, uint32(len(b)-batchHeader))
+			binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(b[batchHeader:]))
+			_, err = j.w.Write(b)
+		}
+		if err == nil {
+			return
+		}
+		// Errors are for the writer to report; the changes themselves
+		// stand.
+		j.lost = make(map[Key]bool)
+	}
+	for _, r := range recs {
+		if r.Op == recClear {
+			j.lost, j.cleared = make(map[Key]bool), true
+		} else {
+			j.lost[r.Key] = true
+		}
+	}
+}
+
+// Journal makes the store record every change from now on to w until it is
+// called again. A nil w stops journaling. Replay reads back what was
+// written. Changes are recorded, a Write holding one or more of them, after
+// their shard is unlocked but before the call making them returns. Changes
+// not yet recorded when Journal is called go to the new w.
+//
+// Once a Write fails, nothing more is written to w; the changes it misses
+// are recorded, as they then stand, at the start of the next w.
+func (s *Sharded) Journal(w io.Writer) {
+	s.log.wmu.Lock()
+	lost, cleared := s.log.lost, s.log.cleared
+	s.log.w, s.log.enc = w, gob.NewEncoder(&s.log.buf)
+	s.log.lost, s.log.cleared = nil, false
+	if cleared {
+		s.log.put([]record{{Op: recClear}})
+	}
+	s.log.Lock()
+	if s.log.on = w != nil; !s.log.on {
+		s.log.queue, s.log.written = nil, s.log.queued
+	}
+	s.log.Unlock()
+	s.log.wmu.Unlock()
+	if w == nil {
+		return
+	}
+	for k := range lost {
+		sh := s.shardFor(k)
+		sh.Lock()
+		sh.mark(k)
+		sh.Unlock()
+	}
+}
+
+// Replay applies the changes recorded by Journal, up to the end of r or
+// the first batch it can't read, such as one cut short by a crash. A batch
+// is applied whole or not at all, so neither is any change made to several
+// items at once. It returns how many records it applied. Replaying on top
+// of a snapshot taken while the journal was being written leaves the store
+// as it was when the last batch was written.
+func (s *Sharded) Replay(r io.Reader) (int, error) {
+	defer s.evict()
+	// The records of every batch are decoded from buf, in one stream, as
+	// the encoder wrote them.
+	var buf bytes.Buffer
+	dec := gob.NewDecoder(&buf)
+	header := make([]byte, batchHeader)
+	n := 0
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf(`reading batch after record %d: %v`, n, err)
+		}
+		size := binary.BigEndian.Uint32(header)
+		buf.Reset()
+		if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+			return n, fmt.Errorf(`reading batch after record %d: %v`, n, err)
+		}
+		if crc32.ChecksumIEEE(buf.Bytes()) != binary.BigEndian.Uint32(header[4:]) {
+			return n, fmt.Errorf(`batch after record %d is corrupt`, n)
+		}
+		var recs []record
+		for buf.Len() > 0 {
+			var rec record
+			if err := dec.Decode(&rec); err != nil {
+				return n, fmt.Errorf(`decoding record %d: %v`, n+len(recs), err)
+			}
+			recs = append(recs, rec)
+		}
+		for _, rec := range recs {
+			s.apply(rec)
+		}
+		n += len(recs)
+	}
+}
+
+func (s *Sharded) apply(rec record) {
+	if rec.Op == recClear {
+		s.lockAll()
+		for _, sh := range s.shards {
+			sh.reset()
+		}
+		s.unlockAll()
+		return
+	}
+	k := rec.Key
+	sh := s.shardFor(k)
+	sh.Lock()
+	defer sh.Unlock()
+	e, live := sh.items[k]
+	if rec.Op == recRead {
+		if live {
+			e.Reads, e.Read = rec.Reads, rec.Read
+		}
+		return
+	}
+	if live {
+		sh.remove(k, e)
+	}
+	if rec.Op == recPut && rec.Entry != nil {
+		e := rec.Entry
+		e.Value = restore(e.Value)
+		s.seen(e.Version)
+		sh.add(k, e)
+	}
+	if g := rec.Grave; g != nil {
+		g.Entry.Value = restore(g.Entry.Value)
+		s.seen(g.Entry.Version)
+		sh.keep(k, g)
+	} else {
+		sh.forget(k)
+	}
+}
+
+// seen makes sure versions handed out from now on are above v.
+func (s *Sharded) seen(v uint64) {
+	for {
+		cur := atomic.LoadUint64(&s.version)
+		if cur >= v || atomic.CompareAndSwapUint64(&s.version, cur, v) {
+			return
+		}
+	}
+}
+
+// mark notes that k changed, to be journaled when the shard is unlocked.
+func (sh *shard) mark(k Key) {
+	sh.dirty[k] = true
+}
+
+// markRead notes that k was read, which only changed its read count.
+func (sh *shard) markRead(k Key) {
+	if _, ok := sh.dirty[k]; !ok {
+		sh.dirty[k] = false
+	}
+}
+
+// Unlock unlocks the shard, then journals the keys changed since it was
+// locked.
+func (sh *shard) Unlock() {
+	sh.log.commit(sh.release())
+}
+
+// release queues records of the keys changed since the shard was locked,
+// then unlocks it, returning the sequence number to commit.
+func (sh *shard) release() uint64 {
+	var seq uint64
+	if len(sh.dirty) > 0 {
+		sh.log.Lock()
+		seq = sh.queue()
+		sh.log.Unlock()
+	}
+	sh.Mutex.Unlock()
+	return seq
+}
+
+// queue queues records of the keys changed since the shard was locked,
+// returning the sequence number to commit. sh.log must be locked.
+func (sh *shard) queue() uint64 {
+	var seq uint64
+	for k, changed := range sh.dirty {
+		rec := record{Key: k}
+		if g := sh.dead[k]; g != nil {
+			c := *g
+			rec.Grave = &c
+		}
+		e, live := sh.items[k]
+		switch {
+		case live && !changed:
+			rec = record{Op: recRead, Key: k, Reads: e.Reads, Read: e.Read}
+		case live:
+			// Copied, since it may change once the shard is unlocked;
+			// values themselves never do.
+			c := *e
+			rec.Op, rec.Entry = recPut, &c
+		default:
+			rec.Op = recDrop
+		}
+		if n := sh.log.add(rec); n > seq {
+			seq = n
+		}
+	}
+	for k := range sh.dirty {
+		delete(sh.dirty, k)
+	}
+	return seq
+}
+
+// release queues recs, then records of what changed in shards, all at once
+// so that they are written together, then unlocks shards. It returns the
+// sequence number to commit.
+func (s *Sharded) release(shards []*shard, recs ...record) uint64 {
+	var seq uint64
+	s.log.Lock()
+	for _, r := range recs {
+		seq = s.log.add(r)
+	}
+	for _, sh := range shards {
+		if n := sh.queue(); n > seq {
+			seq = n
+		}
+	}
+	s.log.Unlock()
+	for _, sh := range shards {
+		sh.Mutex.Unlock()
+	}
+	return seq
+}
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	`encoding/json`
+	`fmt`
+	`math`
+	`net/url`
+	`strconv`
+)
+
+type (
+	// Kind is the JSON type of a key.
+	Kind uint8
+
+	// Key is the canonical form of a cache key: its JSON type plus a
+	// normalized text, so that equal JSON values always make equal keys.
+	// Numbers are float64s as far as JSON is concerned, so 123, 123.0 and
+	// 1.23e2 are the same key, while the string "123" is another.
+	Key struct {
+		Kind Kind
+		Text string
+	}
+)
+
+const (
+	String Kind = iota + 1
+	Number
+	Bool
+)
+
+var kinds = map[Kind]string{
+	String: `string`,
+	Number: `number`,
+	Bool:   `bool`,
+}
+
+func (k Kind) String() string {
+	if s, ok := kinds[k]; ok {
+		return s
+	}
+	return fmt.Sprintf(`Kind(%d)`, uint8(k))
+}
+
+// ParseKind parses the name of a kind, as used in ?type=.
+func ParseKind(s string) (Kind, error) {
+	for k, name := range kinds {
+		if name == s {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf(`unknown key type %q`, s)
+}
+
+func StringKey(s string) Key {
+	return Key{String, s}
+}
+
+func NumberKey(f float64) Key {
+	if f == 0 {
+		f = 0 // Fold -0 into 0.
+	}
+	return Key{Number, strconv.FormatFloat(f, 'g', -1, 64)}
+}
+
+func BoolKey(b bool) Key {
+	return Key{Bool, strconv.FormatBool(b)}
+}
+
+// NewKey makes a key out of a decoded JSON value, or a Go value of the same
+// types. Only strings, numbers and booleans can be keys.
+func NewKey(v interface{}) (Key, error) {
+	switch t := v.(type) {
+	case string:
+		return StringKey(t), nil
+	case bool:
+		return BoolKey(t), nil
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			break
+		}
+		return NumberKey(t), nil
+	case float32:
+		return NewKey(float64(t))
+	case int:
+		return NumberKey(float64(t)), nil
+	case int64:
+		return NumberKey(float64(t)), nil
+	}
+	return Key{}, fmt.Errorf(`keys must be strings, numbers or booleans, got %T`, v)
+}
+
+// ParseKey parses the text of a key of the given kind, as found in a URL.
+func ParseKey(s string, kind Kind) (Key, error) {
+	switch kind {
+	case String:
+		return StringKey(s), nil
+	case Number:
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return NewKey(f)
+		}
+	case Bool:
+		if s == `true` || s == `false` {
+			return Key{Bool, s}, nil
+		}
+	}
+	return Key{}, fmt.Errorf(`%q is not a %v`, s, kind)
+}
+
+// Candidates lists every key the untyped text s may refer to: always the
+// string, plus the number and the boolean if s parses as one.
+func Candidates(s string) []Key {
+	ks := []Key{StringKey(s)}
+	for _, kind := range []Kind{Number, Bool} {
+		if k, err := ParseKey(s, kind); err == nil {
+			ks = append(ks, k)
+		}
+	}
+	return ks
+}
+
+// IsZero reports whether k is the zero Key, which no item can have.
+func (k Key) IsZero() bool {
+	return k.Kind == 0
+}
+
+// Value returns k as a JSON value: a string, float64 or bool.
+func (k Key) Value() interface{} {
+	switch k.Kind {
+	case Number:
+		f, _ := strconv.ParseFloat(k.Text, 64)
+		return f
+	case Bool:
+		return k.Text == `true`
+	}
+	return k.Text
+}
+
+// URLPath returns k as a path segment, escaped, followed by ?type= if the
+// segment alone could refer to other keys as well.
+func (k Key) URLPath() string {
+	p := url.PathEscape(k.Text)
+	if len(Candidates(k.Text)) > 1 {
+		p += `?type=` + k.Kind.String()
+	}
+	return p
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf(`%v:%s`, k.Kind, k.Text)
+}
+
+func (k Key) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.Value())
+}
+
+func (k *Key) UnmarshalJSON(b []byte) (err error) {
+	var v interface{}
+	if err = json.Unmarshal(b, &v); err == nil {
+		*k, err = NewKey(v)
+	}
+	return
+}
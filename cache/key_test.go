@@ -0,0 +1,77 @@
+package cache
+
+import (
+	`encoding/json`
+	`testing`
+)
+
+func TestKeyCanonical(t *testing.T) {
+	same := [][]interface{}{
+		{123, 123.0, int64(123), 1.23e2},
+		{0.0, -0.0},
+		{`123`},
+		{true},
+	}
+	seen := make(map[Key]bool)
+	for _, vs := range same {
+		first := k(vs[0])
+		if seen[first] {
+			t.Errorf(`%v collides with another group.`, vs[0])
+		}
+		seen[first] = true
+		for _, v := range vs[1:] {
+			if k(v) != first {
+				t.Errorf(`%#v made %v, expected %v.`, v, k(v), first)
+			}
+		}
+	}
+
+	for _, v := range []interface{}{nil, map[string]interface{}{}, []interface{}{}} {
+		if _, err := NewKey(v); err == nil {
+			t.Errorf(`NewKey(%#v) succeeded, expected an error.`, v)
+		}
+	}
+}
+
+func TestKeyJSON(t *testing.T) {
+	for _, in := range []string{`"foo"`, `123`, `100.001`, `false`} {
+		var key Key
+		if err := json.Unmarshal([]byte(in), &key); err != nil {
+			t.Fatalf(`Unmarshal(%s) failed: %v`, in, err)
+		}
+		if out, _ := json.Marshal(key); string(out) != in {
+			t.Errorf(`%s came back as %s.`, in, out)
+		}
+	}
+	var key Key
+	if err := json.Unmarshal([]byte(`{"a":1}`), &key); err == nil {
+		t.Errorf(`Unmarshal of an object key succeeded.`)
+	}
+}
+
+func TestKeyURL(t *testing.T) {
+	if ks := Candidates(`100.001000`); len(ks) != 2 || ks[1] != k(100.001) {
+		t.Errorf(`Candidates(100.001000) are %v.`, ks)
+	}
+	if ks := Candidates(`true`); len(ks) != 2 || ks[1] != k(true) {
+		t.Errorf(`Candidates(true) are %v.`, ks)
+	}
+	if ks := Candidates(`1`); len(ks) != 2 || ks[1] != k(1) {
+		t.Errorf(`Candidates(1) are %v, expected no bool.`, ks)
+	}
+	if _, err := ParseKey(`abc`, Number); err == nil {
+		t.Errorf(`ParseKey(abc, number) succeeded.`)
+	}
+
+	for key, want := range map[Key]string{
+		k(`foo`):   `foo`,
+		k(`a/b c`): `a%2Fb%20c`,
+		k(`123`):   `123?type=string`,
+		k(123):     `123?type=number`,
+		k(false):   `false?type=bool`,
+	} {
+		if got := key.URLPath(); got != want {
+			t.Errorf(`%v.URLPath() is %s, expected %s.`, key, got, want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	`container/heap`
+	`sort`
+	`strconv`
+	`strings`
+)
+
+const (
+	// Unordered lists items in no particular order, and ignores After.
+	Unordered Order = iota
+	// ByKey orders keys by type, strings first, then by value: numbers
+	// numerically, strings bytewise, false before true.
+	ByKey
+	// ByVersion lists items in the order they were last changed.
+	ByVersion
+)
+
+// Compare orders keys as ByKey does, returning -1, 0 or +1.
+func Compare(a, b Key) int {
+	if a.Kind != b.Kind {
+		if a.Kind < b.Kind {
+			return -1
+		}
+		return 1
+	}
+	if a.Kind == Number {
+		x, _ := strconv.ParseFloat(a.Text, 64)
+		y, _ := strconv.ParseFloat(b.Text, 64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a.Text, b.Text)
+}
+
+// compare orders items as o says, returning -1, 0 or +1.
+func (o ListOptions) compare(a, b Elt) int {
+	c := 0
+	switch o.Order {
+	case ByKey:
+		c = Compare(a.Key, b.Key)
+	case ByVersion:
+		if a.Version < b.Version {
+			c = -1
+		} else if a.Version > b.Version {
+			c = 1
+		}
+	}
+	if o.Desc {
+		return -c
+	}
+	return c
+}
+
+func (o ListOptions) selects(elt Elt) bool {
+	return (o.Kind == 0 || elt.Key.Kind == o.Kind) &&
+		strings.HasPrefix(elt.Key.Text, o.Prefix) &&
+		(o.After == nil || o.Order == Unordered || o.compare(elt, *o.After) > 0)
+}
+
+// listed is an item copied out of its shard: its key and version, which is
+// all that selecting and ordering it takes, and its entry, to build the Elt
+// from with no lock held, since that may mean decompressing the value.
+type listed struct {
+	ref Elt
+	e   entry
+}
+
+// best keeps the items a page may hold as a heap, worst first, so that a
+// better one can take the worst one's place.
+type best struct {
+	o     ListOptions
+	items []listed
+}
+
+func (b *best) Len() int           { return len(b.items) }
+func (b *best) Less(i, j int) bool { return b.o.compare(b.items[i].ref, b.items[j].ref) > 0 }
+func (b *best) Swap(i, j int)      { b.items[i], b.items[j] = b.items[j], b.items[i] }
+func (b *best) Push(x interface{}) { b.items = append(b.items, x.(listed)) }
+func (b *best) Pop() interface{} {
+	x := b.items[len(b.items)-1]
+	b.items = b.items[:len(b.items)-1]
+	return x
+}
+
+// List keeps only the Limit best items, plus one to tell whether there are
+// more, however many are selected, and builds Elts for those alone.
+func (s *Sharded) List(o ListOptions) ([]Elt, bool) {
+	b := &best{o: o}
+	keep := o.Limit + 1
+	now := s.now()
+	for _, sh := range s.shards {
+		sh.Lock()
+		for k, e := range sh.items {
+			ref := Elt{Key: k, Version: e.Version}
+			if e.expired(now) || !o.selects(ref) {
+				continue
+			}
+			switch {
+			case o.Limit <= 0 || len(b.items) < keep:
+				b.items = append(b.items, listed{ref, *e})
+				if len(b.items) == keep && o.Order != Unordered {
+					heap.Init(b)
+				}
+			case o.Order != Unordered && o.compare(ref, b.items[0].ref) < 0:
+				b.items[0] = listed{ref, *e}
+				heap.Fix(b, 0)
+			}
+		}
+		sh.Unlock()
+	}
+	if o.Order != Unordered {
+		sort.Slice(b.items, func(i, j int) bool { return o.compare(b.items[i].ref, b.items[j].ref) < 0 })
+	}
+	more := o.Limit > 0 && len(b.items) > o.Limit
+	if more {
+		b.items = b.items[:o.Limit]
+	}
+	elts := make([]Elt, len(b.items))
+	for i, c := range b.items {
+		elts[i] = c.e.elt(c.ref.Key)
+	}
+	return elts, more
+}
@@ -0,0 +1,43 @@
+package cache
+
+import (
+	`fmt`
+)
+
+// Incr returns a Modifier adding delta to a numeric value. A missing item
+// is created with the value delta if create is set, and is 404 otherwise.
+// Any other value fails with 409.
+func Incr(delta float64, create bool) Modifier {
+	return func(v interface{}, exists bool) (interface{}, int, error) {
+		if !exists {
+			if create {
+				return delta, 201, nil
+			}
+			return nil, 404, nil
+		}
+		f, ok := v.(float64)
+		if !ok {
+			return nil, 409, fmt.Errorf(`value is %s, not a number`, typeOf(v))
+		}
+		return f + delta, 200, nil
+	}
+}
+
+// typeOf names the JSON type of a decoded value.
+func typeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return `null`
+	case string:
+		return `a string`
+	case float64:
+		return `a number`
+	case bool:
+		return `a boolean`
+	case map[string]interface{}:
+		return `an object`
+	case []interface{}:
+		return `an array`
+	}
+	return fmt.Sprintf(`a %T`, v)
+}
@@ -0,0 +1,338 @@
+package cache
+
+import (
+	`encoding/json`
+	`fmt`
+	`reflect`
+	`strconv`
+	`strings`
+)
+
+// PatchOp is one operation of an RFC 6902 JSON Patch.
+type PatchOp struct {
+	Op    string
+	Path  string
+	From  string
+	Value interface{}
+}
+
+// errTest is returned when a JSON Patch test operation fails.
+type errTest struct {
+	path string
+}
+
+func (e errTest) Error() string {
+	return fmt.Sprintf(`test failed at %q`, e.path)
+}
+
+// MergePatch returns a Modifier applying an RFC 7396 merge patch to an
+// object value. Patching anything but an object fails with 422, as does a
+// patch that isn't an object itself.
+func MergePatch(patch interface{}) Modifier {
+	return func(v interface{}, exists bool) (interface{}, int, error) {
+		if !exists {
+			return nil, 404, nil
+		}
+		p, ok := patch.(map[string]interface{})
+		if !ok {
+			return nil, 422, fmt.Errorf(`merge patch is %s, not an object`, typeOf(patch))
+		}
+		o, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, 422, fmt.Errorf(`value is %s, not an object`, typeOf(v))
+		}
+		return merge(o, p), 200, nil
+	}
+}
+
+// merge applies patch p to a copy of target, leaving both untouched.
+func merge(target interface{}, p interface{}) interface{} {
+	pm, ok := p.(map[string]interface{})
+	if !ok {
+		return p
+	}
+	tm, _ := target.(map[string]interface{})
+	out := make(map[string]interface{}, len(tm)+len(pm))
+	for k, v := range tm {
+		out[k] = v
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(out, k)
+		} else {
+			out[k] = merge(out[k], v)
+		}
+	}
+	return out
+}
+
+// ParsePatch decodes an RFC 6902 JSON Patch document.
+func ParsePatch(b []byte) ([]PatchOp, error) {
+	var raw []map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	ops := make([]PatchOp, len(raw))
+	for i, r := range raw {
+		op := &ops[i]
+		for _, f := range []struct {
+			name string
+			dst  *string
+			need bool
+		}{
+			{`op`, &op.Op, true},
+			{`path`, &op.Path, true},
+			{`from`, &op.From, false},
+		} {
+			if m, ok := r[f.name]; ok {
+				if err := json.Unmarshal(m, f.dst); err != nil {
+					return nil, fmt.Errorf(`operation %d: %s: %v`, i, f.name, err)
+				}
+			} else if f.need {
+				return nil, fmt.Errorf(`operation %d: missing %s`, i, f.name)
+			}
+		}
+		switch op.Op {
+		case `add`, `replace`, `test`:
+			m, ok := r[`value`]
+			if !ok {
+				return nil, fmt.Errorf(`operation %d: missing value`, i)
+			}
+			if err := json.Unmarshal(m, &op.Value); err != nil {
+				return nil, fmt.Errorf(`operation %d: value: %v`, i, err)
+			}
+		case `move`, `copy`:
+			if _, ok := r[`from`]; !ok {
+				return nil, fmt.Errorf(`operation %d: missing from`, i)
+			}
+		case `remove`:
+		default:
+			return nil, fmt.Errorf(`operation %d: unknown op %q`, i, op.Op)
+		}
+	}
+	return ops, nil
+}
+
+// JSONPatch returns a Modifier applying an RFC 6902 JSON Patch. All the
+// operations apply or none do: a failed test fails with 409, and any other
+// failure, such as a path through something that isn't an object or array,
+// fails with 422.
+func JSONPatch(ops []PatchOp) Modifier {
+	return func(v interface{}, exists bool) (interface{}, int, error) {
+		if !exists {
+			return nil, 404, nil
+		}
+		doc := deepCopy(v)
+		for i, op := range ops {
+			var err error
+			if doc, err = op.apply(doc); err != nil {
+				if _, ok := err.(errTest); ok {
+					return nil, 409, err
+				}
+				return nil, 422, fmt.Errorf(`operation %d (%s %s): %v`, i, op.Op, op.Path, err)
+			}
+		}
+		return doc, 200, nil
+	}
+}
+
+func (op PatchOp) apply(doc interface{}) (interface{}, error) {
+	path, err := pointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case `add`:
+		return add(doc, path, deepCopy(op.Value))
+	case `remove`:
+		doc, _, err := remove(doc, path)
+		return doc, err
+	case `replace`:
+		if _, err := find(doc, path); err != nil {
+			return nil, err
+		}
+		return set(doc, path, deepCopy(op.Value))
+	case `move`, `copy`:
+		from, err := pointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		v, err := find(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == `copy` {
+			return add(doc, path, deepCopy(v))
+		}
+		if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+			return nil, fmt.Errorf(`cannot move %q into itself`, op.From)
+		}
+		if doc, _, err = remove(doc, from); err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case `test`:
+		v, err := find(doc, path)
+		if err != nil || !reflect.DeepEqual(v, op.Value) {
+			return nil, errTest{op.Path}
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf(`unknown op %q`, op.Op)
+}
+
+// pointer splits an RFC 6901 JSON Pointer into unescaped tokens.
+func pointer(p string) ([]string, error) {
+	if p == `` {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf(`invalid pointer %q`, p)
+	}
+	toks := strings.Split(p[1:], `/`)
+	for i, t := range toks {
+		toks[i] = strings.Replace(strings.Replace(t, `~1`, `/`, -1), `~0`, `~`, -1)
+	}
+	return toks, nil
+}
+
+// index parses an array index token; end also allows "-" and len(a), for
+// appending.
+func index(tok string, a []interface{}, end bool) (int, error) {
+	n := len(a)
+	if end {
+		if tok == `-` {
+			return n, nil
+		}
+		n++
+	}
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || i >= n || (tok != `0` && tok[0] == '0') {
+		return 0, fmt.Errorf(`invalid array index %q`, tok)
+	}
+	return i, nil
+}
+
+// find returns the value at path.
+func find(doc interface{}, path []string) (interface{}, error) {
+	for _, t := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf(`no member %q`, t)
+			}
+			doc = v
+		case []interface{}:
+			i, err := index(t, c, false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf(`%s is not an object or array`, typeOf(doc))
+		}
+	}
+	return doc, nil
+}
+
+// set stores v at path, which must exist unless it names an object member,
+// and returns the document. Containers are modified in place, so they must
+// be the patch's own copies.
+func set(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	last := path[len(path)-1]
+	c, err := find(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	switch c := c.(type) {
+	case map[string]interface{}:
+		c[last] = v
+	case []interface{}:
+		i, err := index(last, c, false)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = v
+	default:
+		return nil, fmt.Errorf(`%s is not an object or array`, typeOf(c))
+	}
+	return doc, nil
+}
+
+// add inserts v at path: into an array, shifting what follows, or as an
+// object member.
+func add(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	parent := path[:len(path)-1]
+	c, err := find(doc, parent)
+	if err != nil {
+		return nil, err
+	}
+	if a, ok := c.([]interface{}); ok {
+		i, err := index(path[len(path)-1], a, true)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, nil)
+		copy(a[i+1:], a[i:])
+		a[i] = v
+		return set(doc, parent, a)
+	}
+	return set(doc, path, v)
+}
+
+// remove deletes the value at path, returning the document and the value.
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parent, last := path[:len(path)-1], path[len(path)-1]
+	c, err := find(doc, parent)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch c := c.(type) {
+	case map[string]interface{}:
+		v, ok := c[last]
+		if !ok {
+			return nil, nil, fmt.Errorf(`no member %q`, last)
+		}
+		delete(c, last)
+		return doc, v, nil
+	case []interface{}:
+		i, err := index(last, c, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := c[i]
+		doc, err = set(doc, parent, append(c[:i:i], c[i+1:]...))
+		return doc, v, err
+	}
+	return nil, nil, fmt.Errorf(`%s is not an object or array`, typeOf(c))
+}
+
+// deepCopy copies the objects and arrays of a decoded JSON value, so that
+// patches never modify a value someone else may be holding.
+func deepCopy(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			c[k] = deepCopy(v)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(t))
+		for i, v := range t {
+			c[i] = deepCopy(v)
+		}
+		return c
+	}
+	return v
+}
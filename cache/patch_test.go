@@ -0,0 +1,93 @@
+package cache
+
+import (
+	`encoding/json`
+	`reflect`
+	`testing`
+)
+
+// decode parses a JSON literal.
+func decode(t *testing.T, s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf(`Bad JSON %s: %v`, s, err)
+	}
+	return v
+}
+
+func TestMergePatch(t *testing.T) {
+	// From RFC 7396, appendix A, where the target is an object.
+	for _, c := range []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		target := decode(t, c.target)
+		got, ret, err := MergePatch(decode(t, c.patch))(target, true)
+		if ret != 200 || !reflect.DeepEqual(got, decode(t, c.want)) {
+			t.Errorf(`%s + %s = %v, %d, %v; expected %s.`, c.target, c.patch, got, ret, err, c.want)
+		}
+		if !reflect.DeepEqual(target, decode(t, c.target)) {
+			t.Errorf(`Patching modified the target %s.`, c.target)
+		}
+	}
+
+	if _, ret, _ := MergePatch(decode(t, `{"a":1}`))(`string`, true); ret != 422 {
+		t.Errorf(`Merge patch of a string returned %d, expected 422.`, ret)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	for _, c := range []struct {
+		target, patch, want string
+		ret                 int
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"foo":"bar","baz":"qux"}`, 200},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, 200},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["x"]}]`, `{"foo":["bar",["x"]]}`, 200},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, 200},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, 200},
+		{`{"baz":"qux"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo"}`, 200},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, 200},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`, 200},
+		{`{"a":{"b":[1]}}`, `[{"op":"copy","from":"/a/b","path":"/c"}]`, `{"a":{"b":[1]},"c":[1]}`, 200},
+		{`{"a/b":{"m~n":1}}`, `[{"op":"test","path":"/a~1b/m~0n","value":1}]`, `{"a/b":{"m~n":1}}`, 200},
+		{`{"a":[{"b":1}]}`, `[{"op":"replace","path":"/a/0/b","value":2}]`, `{"a":[{"b":2}]}`, 200},
+
+		// Failures leave nothing half applied.
+		{`{"baz":"qux"}`, `[{"op":"add","path":"/x","value":1},{"op":"test","path":"/baz","value":"bar"}]`, ``, 409},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ``, 422},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/foo/bat","value":"qux"}]`, ``, 422},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":1}]`, ``, 422},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/nope"}]`, ``, 422},
+		{`{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/c"}]`, ``, 422},
+	} {
+		ops, err := ParsePatch([]byte(c.patch))
+		if err != nil {
+			t.Fatalf(`ParsePatch(%s) failed: %v`, c.patch, err)
+		}
+		target := decode(t, c.target)
+		got, ret, err := JSONPatch(ops)(target, true)
+		if ret != c.ret || (ret == 200 && !reflect.DeepEqual(got, decode(t, c.want))) {
+			t.Errorf(`%s + %s = %v, %d, %v; expected %s, %d.`, c.target, c.patch, got, ret, err, c.want, c.ret)
+		}
+		if !reflect.DeepEqual(target, decode(t, c.target)) {
+			t.Errorf(`Patching modified the target %s.`, c.target)
+		}
+	}
+
+	for _, bad := range []string{`{}`, `[{"path":"/a"}]`, `[{"op":"add","path":"/a"}]`, `[{"op":"move","path":"/a"}]`, `[{"op":"frob","path":"/a"}]`} {
+		if _, err := ParsePatch([]byte(bad)); err == nil {
+			t.Errorf(`ParsePatch(%s) succeeded.`, bad)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package cache
+
+import (
+	`container/list`
+	`sync`
+	`sync/atomic`
+	`time`
+)
+
+type (
+	// shard is one lock stripe of a Sharded store. Everything below must be
+	// called with the shard locked.
+	shard struct {
+		sync.Mutex
+		items map[Key]*entry
+		lru   *list.List // Front is the most recently used; holds keys.
+		bytes int64
+		tags  map[string]map[Key]bool // The keys carrying each tag.
+		dead  map[Key]*grave          // Deleted items, kept for retention.
+		// Front is the oldest tombstone; holds keys.
+		graves *list.List
+
+		// What the whole store holds, which its capacity bounds.
+		use *usage
+		// How long deleted items are kept; zero means not at all.
+		retention time.Duration
+		// Values whose JSON is at least this long are held compressed;
+		// zero means none are.
+		compress int64
+
+		// How many values are held compressed, and their size before and
+		// after.
+		packed                int
+		packedRaw, packedSize int64
+
+		evictions   uint64
+		expirations uint64
+
+		// Keys changed while locked, and whether more than their read
+		// count changed, for Unlock to journal.
+		dirty map[Key]bool
+		log   *journal
+		// The store's view being taken, if any.
+		view *atomic.Value
+	}
+
+	// entry is an item as held in a shard and written by Save.
+	entry struct {
+		Value    interface{}
+		Version  uint64
+		Reads    int
+		MaxReads int       // Zero means the store's default.
+		Expires  time.Time // Zero means never.
+		Tags     []string
+		// When the item was created, last changed and last read; zero if
+		// unknown, or never read.
+		Created, Updated, Read time.Time
+
+		size int64
+		elem *list.Element
+		used uint64 // When last used, by the store's clock.
+	}
+
+	// usage is what a whole store holds, kept up to date by its shards
+	// with atomic operations.
+	usage struct {
+		items, bytes int64
+		clock        uint64 // Ticks whenever an entry is used.
+	}
+)
+
+// Rough per-item bookkeeping cost (map slot, entry, list element) counted
+// on top of the key and value sizes.
+const entryOverhead = 96
+
+func newShard(use *usage, retention time.Duration, compress int64, log *journal) *shard {
+	return &shard{
+		items:     make(map[Key]*entry),
+		lru:       list.New(),
+		tags:      make(map[string]map[Key]bool),
+		dead:      make(map[Key]*grave),
+		graves:    list.New(),
+		use:       use,
+		retention: retention,
+		compress:  compress,
+		dirty:     make(map[Key]bool),
+		log:       log,
+	}
+}
+
+func (e *entry) elt(k Key) Elt {
+	return Elt{k, e.value(), e.Version, e.Tags}
+}
+
+// value returns the entry's value, decompressed.
+func (e *entry) value() interface{} {
+	return unpack(e.Value)
+}
+
+// setMeta applies the settings m has.
+func (e *entry) setMeta(m Meta) {
+	if !m.Expires.IsZero() {
+		e.Expires = m.Expires
+	}
+	if m.MaxReads != 0 {
+		e.MaxReads = m.MaxReads
+	}
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// lookup returns the live entry for k, dropping it if it has expired.
+func (sh *shard) lookup(k Key, now time.Time) *entry {
+	e, ok := sh.items[k]
+	if !ok {
+		return nil
+	}
+	if e.expired(now) {
+		sh.remove(k, e)
+		sh.expirations++
+		return nil
+	}
+	return e
+}
+
+// add inserts a new entry for k as the most recently used one. It may take
+// the store over capacity until Sharded.evict is called.
+func (sh *shard) add(k Key, e *entry) {
+	e.Value = pack(e.Value, sh.compress)
+	e.size = entryOverhead + sizeOf(k.Text) + sizeOf(e.Value)
+	sh.count(e.Value, 1)
+	e.elem = sh.lru.PushFront(k)
+	e.used = atomic.AddUint64(&sh.use.clock, 1)
+	sh.items[k] = e
+	sh.grow(1, e.size)
+	sh.index(k, e.Tags)
+	sh.mark(k)
+}
+
+// set replaces the value of an existing entry and marks it used.
+func (sh *shard) set(k Key, e *entry, v interface{}) {
+	v = pack(v, sh.compress)
+	size := entryOverhead + sizeOf(k.Text) + sizeOf(v)
+	sh.grow(0, size-e.size)
+	sh.count(e.Value, -1)
+	sh.count(v, 1)
+	e.Value, e.size = v, size
+	sh.mark(k)
+	sh.used(e)
+}
+
+// used marks an entry as the most recently used one.
+func (sh *shard) used(e *entry) {
+	sh.lru.MoveToFront(e.elem)
+	e.used = atomic.AddUint64(&sh.use.clock, 1)
+}
+
+// grow accounts for n more items taking b more bytes, in the shard and the
+// store.
+func (sh *shard) grow(n int, b int64) {
+	sh.bytes += b
+	sh.charge(n, b)
+}
+
+// charge accounts for n more items or tombstones taking b more bytes
+// against the store's capacity.
+func (sh *shard) charge(n int, b int64) {
+	atomic.AddInt64(&sh.use.items, int64(n))
+	atomic.AddInt64(&sh.use.bytes, b)
+}
+
+func (sh *shard) remove(k Key, e *entry) {
+	sh.lru.Remove(e.elem)
+	delete(sh.items, k)
+	sh.grow(-1, -e.size)
+	sh.count(e.Value, -1)
+	sh.unindex(k, e.Tags)
+	sh.mark(k)
+}
+
+// count adds n times v to the compression stats, if it is packed.
+func (sh *shard) count(v interface{}, n int) {
+	if p, ok := v.(packed); ok {
+		sh.packed += n
+		sh.packedRaw += int64(n) * p.Raw
+		sh.packedSize += int64(n * len(p.Data))
+	}
+}
+
+// reset drops every item, leaving tombstones alone.
+func (sh *shard) reset() {
+	sh.grow(-len(sh.items), -sh.bytes)
+	sh.items = make(map[Key]*entry)
+	sh.lru.Init()
+	sh.packed, sh.packedRaw, sh.packedSize = 0, 0, 0
+	sh.tags = make(map[string]map[Key]bool)
+}
+
+// retag replaces the tags of an existing entry.
+func (sh *shard) retag(k Key, e *entry, tags []string) {
+	sh.unindex(k, e.Tags)
+	e.Tags = tags
+	sh.index(k, tags)
+	sh.mark(k)
+}
+
+func (sh *shard) index(k Key, tags []string) {
+	for _, t := range tags {
+		if sh.tags[t] == nil {
+			sh.tags[t] = make(map[Key]bool)
+		}
+		sh.tags[t][k] = true
+	}
+}
+
+func (sh *shard) unindex(k Key, tags []string) {
+	for _, t := range tags {
+		if delete(sh.tags[t], k); len(sh.tags[t]) == 0 {
+			delete(sh.tags, t)
+		}
+	}
+}
+
+// sizeOf approximates the memory held by a decoded JSON value.
+func sizeOf(v interface{}) int64 {
+	switch t := v.(type) {
+	case string:
+		return 16 + int64(len(t))
+	case map[string]interface{}:
+		n := int64(48)
+		for k, v := range t {
+			n += sizeOf(k) + sizeOf(v)
+		}
+		return n
+	case []interface{}:
+		n := int64(24)
+		for _, v := range t {
+			n += sizeOf(v)
+		}
+		return n
+	case packed:
+		return 32 + int64(len(t.Data))
+	default:
+		return 16
+	}
+}
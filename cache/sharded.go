@@ -0,0 +1,596 @@
+package cache
+
+import (
+	`bytes`
+	`encoding/gob` // Persistence
+	`fmt`
+	`hash/fnv`
+	`io`
+	`io/ioutil`
+	`sync`
+	`sync/atomic`
+	`time`
+)
+
+type (
+	// Sharded is the default Store: an in-memory map striped across
+	// independently locked shards, persisted with encoding/gob. Single-key
+	// operations on different shards never contend.
+	Sharded struct {
+		shards   []*shard
+		maxReads int
+		// Capacity; zero means unbounded.
+		maxItems int64
+		maxBytes int64
+		use      usage
+		version  uint64 // Last version handed out.
+		now      func() time.Time
+		log      *journal
+		// The view Export is taking, if any; one at a time.
+		view    atomic.Value
+		viewing sync.Mutex
+	}
+
+	// snapshot is what Save writes.
+	snapshot struct {
+		Version uint64
+		Items   map[Key]entry
+		Dead    map[Key]grave
+	}
+)
+
+var (
+	_ Store     = (*Sharded)(nil)
+	_ Persister = (*Sharded)(nil)
+)
+
+// Values are decoded JSON, so besides the basic types gob is told about the
+// containers objects and arrays decode into.
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// New returns an empty Sharded store.
+func New(o Options) *Sharded {
+	n := o.Shards
+	if n <= 0 {
+		n = DefaultShards
+	}
+	s := &Sharded{
+		shards:   make([]*shard, n),
+		maxReads: o.MaxReads,
+		maxItems: int64(o.MaxItems),
+		maxBytes: o.MaxBytes,
+		now:      time.Now,
+		log:      &journal{},
+	}
+	if s.maxReads == 0 {
+		s.maxReads = DefaultMaxReads
+	}
+	for i := range s.shards {
+		s.shards[i] = newShard(&s.use, o.Retention, o.Compress, s.log)
+		s.shards[i].view = &s.view
+	}
+	return s
+}
+
+// over reports whether the store holds more than its capacity, not counting
+// the most recently used item, which is always kept however large.
+func (s *Sharded) over() bool {
+	n := atomic.LoadInt64(&s.use.items)
+	return n > 1 && (s.maxItems > 0 && n > s.maxItems ||
+		s.maxBytes > 0 && atomic.LoadInt64(&s.use.bytes) > s.maxBytes)
+}
+
+// evict drops tombstones, oldest first, then the least recently used items,
+// store-wide, until the store is back within capacity. Operations that add
+// or grow items call it once they have let go of every shard, so that
+// atomic ones never evict what they may yet roll back to.
+func (s *Sharded) evict() {
+	for s.over() {
+		if !s.evictGrave() && !s.evictItem() {
+			return
+		}
+	}
+}
+
+// evictGrave drops the oldest tombstone, reporting whether there was one.
+func (s *Sharded) evictGrave() bool {
+	// Every shard's list of tombstones starts with its oldest; the oldest
+	// of those goes.
+	var victim *shard
+	var oldest time.Time
+	for _, sh := range s.shards {
+		sh.Lock()
+		if front := sh.graves.Front(); front != nil {
+			if g := sh.dead[front.Value.(Key)]; victim == nil || g.Deleted.Before(oldest) {
+				victim, oldest = sh, g.Deleted
+			}
+		}
+		sh.Unlock()
+	}
+	if victim == nil {
+		return false
+	}
+	victim.Lock()
+	if front := victim.graves.Front(); front != nil && s.over() {
+		victim.forget(front.Value.(Key))
+	}
+	victim.Unlock()
+	return true
+}
+
+// evictItem drops the least recently used item, reporting whether there was
+// one.
+func (s *Sharded) evictItem() bool {
+	// Every shard's LRU list ends with its oldest entry; the oldest of
+	// those goes.
+	var victim *shard
+	var oldest uint64
+	for _, sh := range s.shards {
+		sh.Lock()
+		if back := sh.lru.Back(); back != nil {
+			if e := sh.items[back.Value.(Key)]; victim == nil || e.used < oldest {
+				victim, oldest = sh, e.used
+			}
+		}
+		sh.Unlock()
+	}
+	if victim == nil {
+		return false
+	}
+	victim.Lock()
+	if back := victim.lru.Back(); back != nil && s.over() {
+		k := back.Value.(Key)
+		victim.remove(k, victim.items[k])
+		victim.evictions++
+	}
+	victim.Unlock()
+	return true
+}
+
+// shardIndex picks the shard owning k.
+func (s *Sharded) shardIndex(k Key) int {
+	h := fnv.New32a()
+	h.Write([]byte{byte(k.Kind)})
+	h.Write([]byte(k.Text))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *Sharded) shardFor(k Key) *shard {
+	return s.shards[s.shardIndex(k)]
+}
+
+// nextVersion hands out versions, unique and increasing across the store.
+func (s *Sharded) nextVersion() uint64 {
+	return atomic.AddUint64(&s.version, 1)
+}
+
+// bump gives e a new version, changed as of now.
+func (s *Sharded) bump(e *entry) {
+	e.Version = s.nextVersion()
+	e.Updated = s.now()
+	if e.Created.IsZero() {
+		e.Created = e.Updated
+	}
+}
+
+// check evaluates c against e, which is nil if the item doesn't exist.
+func check(c Cond, e *entry) bool {
+	if e == nil {
+		return c.Holds(0, false)
+	}
+	return c.Holds(e.Version, true)
+}
+
+func (s *Sharded) Update(k Key, v interface{}, m Meta, c Cond) (uint64, int) {
+	defer s.evict()
+	sh := s.shardFor(k)
+	sh.Lock()
+	defer sh.Unlock()
+	return s.update(sh, k, v, m, c)
+}
+
+// update, like the other lowercase operations, is its uppercase
+// counterpart for a caller holding the lock of sh, the shard owning k.
+func (s *Sharded) update(sh *shard, k Key, v interface{}, m Meta, c Cond) (uint64, int) {
+	e := sh.lookup(k, s.now())
+	if !check(c, e) {
+		return 0, 412
+	}
+	if e == nil {
+		return 0, 404
+	}
+	sh.set(k, e, v)
+	e.setMeta(m)
+	if m.Tags != nil {
+		sh.retag(k, e, m.Tags)
+	}
+	s.bump(e)
+	return e.Version, 204
+}
+
+func (s *Sharded) Upsert(k Key, v interface{}, m Meta, c Cond) (uint64, int) {
+	defer s.evict()
+	sh := s.shardFor(k)
+	sh.Lock()
+	defer sh.Unlock()
+	return s.upsert(sh, k, v, m, c)
+}
+
+func (s *Sharded) upsert(sh *shard, k Key, v interface{}, m Meta, c Cond) (uint64, int) {
+	e := sh.lookup(k, s.now())
+	if !check(c, e) {
+		return 0, 412
+	}
+	if e == nil {
+		return s.create(sh, k, v, m)
+	}
+	return s.update(sh, k, v, m, Cond{})
+}
+
+func (s *Sharded) Rename(from, to Key, v interface{}, m Meta, c Cond) (uint64, int) {
+	defer s.evict()
+	defer s.unlock(s.lock([]Key{from, to}))
+	if from == to {
+		return s.update(s.shardFor(to), to, v, m, c)
+	}
+	now := s.now()
+	sh := s.shardFor(from)
+	e := sh.lookup(from, now)
+	if !check(c, e) {
+		return 0, 412
+	}
+	if e == nil {
+		return 0, 404
+	}
+	if s.shardFor(to).lookup(to, now) != nil {
+		return 0, 409
+	}
+	sh.remove(from, e)
+	e.Value = v
+	e.setMeta(m)
+	if m.Tags != nil {
+		e.Tags = m.Tags
+	}
+	s.bump(e)
+	s.shardFor(to).add(to, e)
+	return e.Version, 204
+}
+
+func (s *Sharded) Create(k Key, v interface{}, m Meta) (uint64, int) {
+	defer s.evict()
+	sh := s.shardFor(k)
+	sh.Lock()
+	defer sh.Unlock()
+	return s.create(sh, k, v, m)
+}
+
+func (s *Sharded) create(sh *shard, k Key, v interface{}, m Meta) (uint64, int) {
+	if e := sh.lookup(k, s.now()); e != nil {
+		return 0, 409
+	}
+	e := &entry{Value: v, Expires: m.Expires, MaxReads: m.MaxReads, Tags: m.Tags}
+	s.bump(e)
+	sh.add(k, e)
+	return e.Version, 201
+}
+
+// readLimit is the number of reads e survives, or Unlimited.
+func (s *Sharded) readLimit(e *entry) int {
+	if e.MaxReads != 0 {
+		return e.MaxReads
+	}
+	return s.maxReads
+}
+
+func (s *Sharded) Get(k Key) (Elt, int) {
+	sh := s.shardFor(k)
+	sh.Lock()
+	defer sh.Unlock()
+	return s.get(sh, k)
+}
+
+func (s *Sharded) get(sh *shard, k Key) (Elt, int) {
+	if e := sh.lookup(k, s.now()); e != nil {
+		e.Reads++
+		e.Read = s.now()
+		sh.markRead(k)
+		if max := s.readLimit(e); max != Unlimited && e.Reads >= max {
+			sh.remove(k, e)
+		} else {
+			sh.used(e)
+		}
+		return e.elt(k), 200
+	}
+	return Elt{}, 404
+}
+
+func (s *Sharded) Describe(k Key) (Info, int) {
+	sh := s.shardFor(k)
+	sh.Lock()
+	defer sh.Unlock()
+	if e := sh.lookup(k, s.now()); e != nil {
+		return Info{
+			Key:      k,
+			Version:  e.Version,
+			Created:  e.Created,
+			Updated:  e.Updated,
+			Read:     e.Read,
+			Reads:    e.Reads,
+			MaxReads: s.readLimit(e),
+			Expires:  e.Expires,
+			Size:     e.size,
+			Tags:     e.Tags,
+		}, 200
+	}
+	return Info{}, 404
+}
+
+func (s *Sharded) Peek(k Key) (Elt, int) {
+	sh := s.shardFor(k)
+	sh.Lock()
+	defer sh.Unlock()
+	if e := sh.lookup(k, s.now()); e != nil {
+		return e.elt(k), 200
+	}
+	return Elt{}, 404
+}
+
+func (s *Sharded) Modify(k Key, c Cond, fn Modifier) (Elt, int, error) {
+	defer s.evict()
+	sh := s.shardFor(k)
+	sh.Lock()
+	defer sh.Unlock()
+	e := sh.lookup(k, s.now())
+	if !check(c, e) {
+		return Elt{}, 412, nil
+	}
+	var (
+		v   interface{}
+		ret int
+		err error
+	)
+	if e == nil {
+		v, ret, err = fn(nil, false)
+	} else {
+		v, ret, err = fn(e.value(), true)
+	}
+	switch {
+	case ret == 200 && e != nil:
+		sh.set(k, e, v)
+	case ret == 201 && e == nil:
+		e = &entry{Value: v}
+		sh.add(k, e)
+	default:
+		return Elt{}, ret, err
+	}
+	s.bump(e)
+	return e.elt(k), ret, nil
+}
+
+func (s *Sharded) Delete(k Key, c Cond) int {
+	sh := s.shardFor(k)
+	sh.Lock()
+	defer sh.Unlock()
+	return s.delete(sh, k, c)
+}
+
+func (s *Sharded) delete(sh *shard, k Key, c Cond) int {
+	e := sh.lookup(k, s.now())
+	if !check(c, e) {
+		return 412
+	}
+	if e == nil {
+		return 404
+	}
+	sh.bury(k, e, s.now())
+	return 204
+}
+
+// Clear locks every shard at once, so that it is journaled as one change.
+func (s *Sharded) Clear() {
+	now := s.now()
+	s.lockAll()
+	defer func() { s.log.commit(s.release(s.shards, record{Op: recClear})) }()
+	for _, sh := range s.shards {
+		if sh.retention > 0 {
+			for k, e := range sh.items {
+				if !e.expired(now) {
+					sh.bury(k, e, now)
+				}
+			}
+		}
+		sh.reset()
+	}
+}
+
+func (s *Sharded) Sweep() int {
+	n := 0
+	now := s.now()
+	for _, sh := range s.shards {
+		sh.Lock()
+		for k, e := range sh.items {
+			if e.expired(now) {
+				sh.remove(k, e)
+				sh.expirations++
+				n++
+			}
+		}
+		sh.purge(now)
+		sh.Unlock()
+	}
+	return n
+}
+
+func (s *Sharded) Stats() (st Stats) {
+	for _, sh := range s.shards {
+		sh.Lock()
+		st.Items += len(sh.items)
+		st.Bytes += sh.bytes
+		st.Evictions += sh.evictions
+		st.Expirations += sh.expirations
+		st.Tombstones += len(sh.dead)
+		st.Compressed += sh.packed
+		st.CompressedBytes += sh.packedSize
+		st.UncompressedBytes += sh.packedRaw
+		sh.Unlock()
+	}
+	if st.CompressedBytes > 0 {
+		st.Ratio = float64(st.UncompressedBytes) / float64(st.CompressedBytes)
+	}
+	return
+}
+
+// copyShards takes a point-in-time copy of every live entry, locking one
+// shard at a time so writers elsewhere keep going while we walk the store.
+func (s *Sharded) copyShards() map[Key]entry {
+	c := make(map[Key]entry)
+	now := s.now()
+	for _, sh := range s.shards {
+		sh.Lock()
+		for k, e := range sh.items {
+			if !e.expired(now) {
+				c[k] = *e
+			}
+		}
+		sh.Unlock()
+	}
+	return c
+}
+
+func (s *Sharded) Snapshot() []Elt {
+	c := s.copyShards()
+	elts := make([]Elt, 0, len(c))
+	for k, e := range c {
+		elts = append(elts, e.elt(k))
+	}
+	return elts
+}
+
+func (s *Sharded) Export(fn func(Elt) error) error {
+	// Values are never modified in place, so copies of the entries are
+	// enough. They are decompressed one at a time as they are streamed,
+	// with no lock held.
+	v := s.takeView()
+	for _, sh := range s.shards {
+		c := v.parts[sh].c
+		for i := range c {
+			if err := fn(c[i].e.elt(c[i].ref.Key)); err != nil {
+				return err
+			}
+			c[i] = listed{}
+		}
+	}
+	return nil
+}
+
+// Save gob-encodes the map of entries, read counts, expiry deadlines and
+// versions included, so a restart neither resurrects nor prolongs anything
+// and never hands out a version twice.
+func (s *Sharded) Save(w io.Writer) (int, error) {
+	snap := snapshot{Version: atomic.LoadUint64(&s.version), Dead: make(map[Key]grave)}
+	snap.Items = s.copyShards()
+	for _, sh := range s.shards {
+		sh.Lock()
+		for k, g := range sh.dead {
+			snap.Dead[k] = *g
+		}
+		sh.Unlock()
+	}
+	if err := gob.NewEncoder(w).Encode(snap); err != nil {
+		return 0, fmt.Errorf(`encoding cache: %v`, err)
+	}
+	return len(snap.Items), nil
+}
+
+func (s *Sharded) Load(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf(`reading cache: %v`, err)
+	}
+	var snap snapshot
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&snap); err != nil {
+		legacy, lerr := decodeLegacy(b, s.now())
+		if lerr != nil {
+			return fmt.Errorf(`decoding cache: %v`, err)
+		}
+		snap = legacy
+	}
+	defer s.evict()
+	s.lockAll()
+	defer s.unlockAll()
+	for _, sh := range s.shards {
+		sh.reset()
+		for k := range sh.dead {
+			sh.forget(k)
+		}
+	}
+	atomic.StoreUint64(&s.version, snap.Version)
+	now := s.now()
+	for k, e := range snap.Items {
+		if e.expired(now) {
+			continue
+		}
+		e := e
+		e.Value = restore(e.Value)
+		s.shardFor(k).add(k, &e)
+	}
+	for k, g := range snap.Dead {
+		g := g
+		g.Entry.Value = restore(g.Entry.Value)
+		s.shardFor(k).keep(k, &g)
+	}
+	return nil
+}
+
+// decodeLegacy reads a snapshot as the service wrote it before this package
+// existed: a gob map of values by key, then one of read counts. Items get
+// fresh versions and timestamps. Keys that were told apart only by their Go
+// type, such as 123 and 123.0, are now the same key, and only one survives.
+func decodeLegacy(b []byte, now time.Time) (snapshot, error) {
+	var (
+		items  map[interface{}]interface{}
+		counts map[interface{}]int
+	)
+	dec := gob.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(&items); err != nil {
+		return snapshot{}, err
+	}
+	// The counts were written second, so a failure to write them left the
+	// items usable.
+	dec.Decode(&counts)
+	snap := snapshot{Items: make(map[Key]entry, len(items))}
+	for k, v := range items {
+		key, err := NewKey(k)
+		if err != nil {
+			return snapshot{}, err
+		}
+		snap.Version++
+		snap.Items[key] = entry{Value: v, Version: snap.Version, Reads: counts[k], Created: now, Updated: now}
+	}
+	return snap, nil
+}
+
+// restore undoes what gob does to empty containers, which come back as nil
+// and would otherwise be served as null.
+func restore(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if t == nil {
+			return map[string]interface{}{}
+		}
+		for k, c := range t {
+			t[k] = restore(c)
+		}
+	case []interface{}:
+		if t == nil {
+			return []interface{}{}
+		}
+		for i, c := range t {
+			t[i] = restore(c)
+		}
+	}
+	return v
+}
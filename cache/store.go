@@ -0,0 +1,278 @@
+// Package cache holds the key/value store behind the caching service.
+//
+// Keys are JSON strings, numbers or booleans in canonical form (see Key);
+// values are whatever JSON decodes to. Store methods report their outcome as the HTTP status code the
+// service hands back to clients (201 created, 204 updated, 404 missing,
+// 409 conflict), so handlers can pass them straight through.
+package cache
+
+import (
+	`io`
+	`time`
+)
+
+type (
+	// Elt is a single key/value pair as emitted to clients.
+	Elt struct {
+		Key     Key         `json:"key"`
+		Value   interface{} `json:"value"`
+		Version uint64      `json:"-"`
+		Tags    []string    `json:"tags,omitempty"`
+	}
+
+	// Info describes an item, all but its value.
+	Info struct {
+		Key     Key
+		Version uint64
+		// When the item was created, last changed and last read; zero if
+		// unknown, or never read.
+		Created, Updated, Read time.Time
+		// Reads counts reads so far, out of MaxReads, which is a count or
+		// Unlimited.
+		Reads, MaxReads int
+		Expires         time.Time // Zero means never.
+		Size            int64     // Approximate bytes held.
+		Tags            []string
+	}
+
+	// Meta carries the optional per-item settings accepted by Create and
+	// Update. Zero fields are left alone.
+	Meta struct {
+		// Expires is when the item stops being visible. Expired items are
+		// dropped lazily when touched and actively by Sweep.
+		Expires time.Time
+		// MaxReads is how many reads the item survives: a positive count,
+		// or Unlimited. Zero means the store's default.
+		MaxReads int
+		// Tags group items for Tagged and DeleteTagged. Unless nil, they
+		// replace those the item had.
+		Tags []string
+	}
+
+	// Cond is a precondition on the version of an item, checked atomically
+	// with the operation it guards, which fails with 412 if it doesn't
+	// hold. Either list may hold Any, which stands for every version like
+	// * in HTTP. The zero Cond always holds.
+	Cond struct {
+		// IfMatch, unless nil, lists the versions the item may have. A
+		// missing item matches nothing, so an empty list never holds.
+		IfMatch []uint64
+		// IfNoneMatch lists versions the item must not have.
+		IfNoneMatch []uint64
+	}
+
+	// Modifier computes the new value of an item from its current one,
+	// which is nil with exists false if the item is missing. It returns
+	// 200 to keep the new value, 201 to create a missing item with it, or
+	// another status and why to fail.
+	Modifier func(v interface{}, exists bool) (interface{}, int, error)
+
+	// Op is one operation of a batch: create, update or upsert k with
+	// Value and Meta, or delete or get it.
+	Op struct {
+		Op    string
+		Key   Key
+		Value interface{}
+		Meta  Meta
+	}
+
+	// Result is the outcome of an Op: its status and the item as it left
+	// it, Value included only for get.
+	Result struct {
+		Status int
+		Elt    Elt
+	}
+
+	// Tombstone is a deleted item, kept for a while in case it is wanted
+	// back.
+	Tombstone struct {
+		Elt
+		Deleted time.Time
+	}
+
+	// Check is a precondition of a transaction: that Key exists, and if
+	// so, has Value if HasValue and Version unless that is Any; or, if
+	// Exists is false, that it doesn't.
+	Check struct {
+		Key      Key
+		Exists   bool
+		Value    interface{}
+		HasValue bool
+		Version  uint64
+	}
+
+	// Order is the order List returns items in.
+	Order int
+
+	// ListOptions selects the items List returns.
+	ListOptions struct {
+		// Prefix and Kind, unless zero, restrict the keys listed.
+		Prefix string
+		Kind   Kind
+		Order  Order
+		Desc   bool
+		// After, unless nil, is where the previous page ended: only items
+		// after it in Order are listed. Only the fields Order looks at
+		// matter.
+		After *Elt
+		// Limit, unless zero, is the most items to return.
+		Limit int
+	}
+
+	// Store is the interface the service talks to. Implementations must be
+	// safe for concurrent use.
+	Store interface {
+		// Create adds k if it isn't present yet: 201, or 409 if it is.
+		// Every change to an item gives it a new version, which Create and
+		// Update return.
+		Create(k Key, v interface{}, m Meta) (uint64, int)
+		// Update replaces the value of an existing k, and its settings
+		// where m has them: 204, 404 or 412.
+		Update(k Key, v interface{}, m Meta, c Cond) (uint64, int)
+		// Upsert is Update, creating k if it is missing: 201, 204 or 412.
+		Upsert(k Key, v interface{}, m Meta, c Cond) (uint64, int)
+		// Rename is Update moving the item from one key to another, read
+		// count and settings included: 204, 404, 409 if to exists, or 412
+		// if c doesn't hold for from.
+		Rename(from, to Key, v interface{}, m Meta, c Cond) (uint64, int)
+		// Get returns the item k and counts a read against it: 200, or 404.
+		Get(k Key) (Elt, int)
+		// Describe returns what there is to know about k but its value,
+		// without counting a read: 200, or 404.
+		Describe(k Key) (Info, int)
+		// Peek is Get without counting a read.
+		Peek(k Key) (Elt, int)
+		// Modify atomically replaces the value of k with what fn makes of
+		// it, and returns the item as modified: 200 or 201 as fn says, or
+		// 412. Whatever else fn returns is passed on, with its error, and
+		// the store left alone.
+		Modify(k Key, c Cond, fn Modifier) (Elt, int, error)
+		// Delete removes k: 204, 404 or 412. Delete, DeleteTagged and
+		// Clear leave tombstones if the store keeps them.
+		Delete(k Key, c Cond) int
+		// Undelete restores k from its tombstone, with a new version:
+		// 201, 404 if there is none, or 409 if k exists again.
+		Undelete(k Key) (Elt, int)
+		// Tombstones lists the items that can be undeleted, most recently
+		// deleted first.
+		Tombstones() []Tombstone
+		// Batch runs ops in order and returns their results. An unknown
+		// op fails with 406. If atomic, the batch runs as a whole under
+		// the locks of every item it touches, and unless all of it
+		// succeeds none of it takes effect: the ops that failed report
+		// why, the others 424.
+		Batch(ops []Op, atomic bool) []Result
+		// Txn runs ops as an atomic Batch if every one of checks holds,
+		// evaluating them under the same locks. It returns the indexes of
+		// the checks that failed, in which case every op reports 424,
+		// and the results of ops.
+		Txn(checks []Check, ops []Op) ([]int, []Result)
+		// Tagged returns the items tagged tag, without counting reads.
+		// DeleteTagged removes them all at once and returns how many it
+		// removed.
+		Tagged(tag string) []Elt
+		DeleteTagged(tag string) int
+		// Clear drops every item.
+		Clear()
+		// Sweep drops every expired item and returns how many it dropped.
+		// It also purges tombstones past retention.
+		Sweep() int
+		// Stats reports the size of the store and what it has dropped.
+		Stats() Stats
+		// Snapshot returns all items, in no particular order. Reads are
+		// not counted.
+		Snapshot() []Elt
+		// Export passes every item to fn, in no particular order, until fn
+		// fails. The items are a consistent snapshot of the store, though
+		// no writer is held up for longer than it takes to copy the shards
+		// it locks, nor while fn runs. Reads are not counted.
+		Export(fn func(Elt) error) error
+		// List returns the items o selects, without counting reads, and
+		// whether there are more beyond o.Limit.
+		List(o ListOptions) ([]Elt, bool)
+	}
+
+	// Persister is implemented by stores that can be kept on disk.
+	Persister interface {
+		// Save writes the store to w and returns the number of items
+		// written. Load replaces the contents with what Save wrote.
+		Save(w io.Writer) (int, error)
+		Load(r io.Reader) error
+		// Journal records every change from now on to w, for Replay to
+		// apply on top of a snapshot Save took since. A nil w stops it.
+		Journal(w io.Writer)
+		Replay(r io.Reader) (int, error)
+	}
+
+	// Stats is a point-in-time summary of a store.
+	Stats struct {
+		Items       int    `json:"items"`
+		Bytes       int64  `json:"bytes"` // Approximate.
+		Evictions   uint64 `json:"evictions"`
+		Expirations uint64 `json:"expirations"`
+		Tombstones  int    `json:"tombstones"`
+		// How many values are held compressed, their size before and
+		// after, and the ratio of the two.
+		Compressed        int     `json:"compressed"`
+		UncompressedBytes int64   `json:"uncompressed_bytes"`
+		CompressedBytes   int64   `json:"compressed_bytes"`
+		Ratio             float64 `json:"compression_ratio"`
+	}
+
+	// Options configures a store built by New.
+	Options struct {
+		// Shards is the number of lock stripes. Zero means DefaultShards.
+		Shards int
+		// MaxItems and MaxBytes bound the store; once either is exceeded
+		// the least recently used items are evicted. Zero means unbounded.
+		MaxItems int
+		MaxBytes int64
+		// MaxReads is the default read limit for items that don't set
+		// their own. Zero means DefaultMaxReads.
+		MaxReads int
+		// Retention is how long deleted items are kept as tombstones,
+		// hidden but restorable by Undelete. Zero means deletes are final.
+		Retention time.Duration
+		// Compress, unless zero, is the JSON length from which values are
+		// held compressed, in memory and in snapshots. They are only
+		// decompressed when read.
+		Compress int64
+	}
+)
+
+const (
+	// DefaultShards is the number of lock stripes used when Options
+	// doesn't say otherwise.
+	DefaultShards = 64
+
+	// DefaultMaxReads is the number of reads after which an item is
+	// purged, unless it or the store says otherwise.
+	DefaultMaxReads = 100
+
+	// Unlimited as a read limit means an item is never purged by reads.
+	Unlimited = -1
+
+	// Any in a Cond matches every version. Versions start at 1.
+	Any uint64 = 0
+)
+
+// Holds reports whether c holds for an item with the given version, or for
+// a missing item if exists is false.
+func (c Cond) Holds(version uint64, exists bool) bool {
+	if c.IfMatch != nil && !(exists && matches(c.IfMatch, version)) {
+		return false
+	}
+	if c.IfNoneMatch != nil && exists && matches(c.IfNoneMatch, version) {
+		return false
+	}
+	return true
+}
+
+func matches(vs []uint64, version uint64) bool {
+	for _, v := range vs {
+		if v == Any || v == version {
+			return true
+		}
+	}
+	return false
+}
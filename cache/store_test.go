@@ -0,0 +1,1157 @@
+package cache
+
+// To run:
+// go test -v ./cache
+
+import (
+	`bytes`
+	`encoding/gob`
+	`encoding/json`
+	`fmt`
+	`io`
+	`reflect`
+	`sort`
+	`strings`
+	`sync/atomic`
+	`testing`
+	`time`
+)
+
+// k makes a key from a Go value, for brevity.
+func k(v interface{}) Key {
+	key, err := NewKey(v)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func TestCreateGetUpdate(t *testing.T) {
+	s := New(Options{})
+
+	if _, ret := s.Create(k(`foo`), `bar`, Meta{}); ret != 201 {
+		t.Fatalf(`Create returned %d, expected 201.`, ret)
+	}
+	if _, ret := s.Create(k(`foo`), `baz`, Meta{}); ret != 409 {
+		t.Errorf(`Duplicate Create returned %d, expected 409.`, ret)
+	}
+	if _, ret := s.Update(k(`foo`), `baz`, Meta{}, Cond{}); ret != 204 {
+		t.Errorf(`Update returned %d, expected 204.`, ret)
+	}
+	if _, ret := s.Update(k(`nope`), `baz`, Meta{}, Cond{}); ret != 404 {
+		t.Errorf(`Update of missing key returned %d, expected 404.`, ret)
+	}
+
+	elt, ret := s.Get(k(`foo`))
+	if ret != 200 || elt.Key != k(`foo`) || elt.Value != `baz` {
+		t.Errorf(`Get returned %v, %d; expected {foo baz}, 200.`, elt, ret)
+	}
+	if _, ret := s.Get(k(`nope`)); ret != 404 {
+		t.Errorf(`Get of missing key returned %d, expected 404.`, ret)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	s := New(Options{})
+	s.Create(k(`hot`), 1.0, Meta{})
+	for i := 0; i < DefaultMaxReads; i++ {
+		if _, ret := s.Get(k(`hot`)); ret != 200 {
+			t.Fatalf(`Read %d returned %d, expected 200.`, i+1, ret)
+		}
+	}
+	if _, ret := s.Get(k(`hot`)); ret != 404 {
+		t.Errorf(`Read past the limit returned %d, expected 404.`, ret)
+	}
+}
+
+func TestClear(t *testing.T) {
+	s := New(Options{Shards: 4})
+	for _, v := range []interface{}{`a`, 1.0, false} {
+		s.Create(k(v), v, Meta{})
+	}
+	s.Clear()
+	if n := len(s.Snapshot()); n != 0 {
+		t.Errorf(`%d items left after Clear, expected 0.`, n)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	s := New(Options{})
+	s.Create(k(`foo`), `bar`, Meta{})
+	s.Create(k(1.5), true, Meta{})
+	s.Get(k(`foo`))
+
+	var buf bytes.Buffer
+	if n, err := s.Save(&buf); err != nil || n != 2 {
+		t.Fatalf(`Save returned %d, %v; expected 2, nil.`, n, err)
+	}
+
+	l := New(Options{Shards: 3})
+	if err := l.Load(&buf); err != nil {
+		t.Fatalf(`Load failed: %v`, err)
+	}
+	if n := len(l.Snapshot()); n != 2 {
+		t.Errorf(`Loaded %d items, expected 2.`, n)
+	}
+	for i := 1; i < DefaultMaxReads; i++ {
+		l.Get(k(`foo`))
+	}
+	if _, ret := l.Get(k(`foo`)); ret != 404 {
+		t.Errorf(`Read counts were not restored, got %d on read %d.`, ret, DefaultMaxReads+1)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+	s := New(Options{})
+	s.now = func() time.Time { return now }
+
+	s.Create(k(`short`), 1.0, Meta{Expires: now.Add(time.Second)})
+	s.Create(k(`long`), 2.0, Meta{Expires: now.Add(time.Hour)})
+	s.Create(k(`forever`), 3.0, Meta{})
+
+	now = now.Add(time.Minute)
+	if _, ret := s.Get(k(`short`)); ret != 404 {
+		t.Errorf(`Get of expired item returned %d, expected 404.`, ret)
+	}
+	if _, ret := s.Create(k(`short`), 4.0, Meta{}); ret != 201 {
+		t.Errorf(`Create over expired item returned %d, expected 201.`, ret)
+	}
+
+	// Updating without a deadline keeps the old one.
+	s.Update(k(`long`), 5.0, Meta{}, Cond{})
+	now = now.Add(time.Hour)
+	if n := s.Sweep(); n != 1 {
+		t.Errorf(`Sweep dropped %d items, expected 1.`, n)
+	}
+	if n := len(s.Snapshot()); n != 2 {
+		t.Errorf(`%d items left after Sweep, expected 2.`, n)
+	}
+}
+
+func TestSaveLoadExpiry(t *testing.T) {
+	now := time.Now()
+	s := New(Options{})
+	s.now = func() time.Time { return now }
+	s.Create(k(`soon`), 1.0, Meta{Expires: now.Add(time.Second)})
+	s.Create(k(`later`), 2.0, Meta{Expires: now.Add(time.Hour)})
+
+	var buf bytes.Buffer
+	s.Save(&buf)
+
+	// Load after the first deadline has passed: it must stay gone.
+	l := New(Options{})
+	l.now = func() time.Time { return now.Add(time.Minute) }
+	if err := l.Load(&buf); err != nil {
+		t.Fatalf(`Load failed: %v`, err)
+	}
+	if elts := l.Snapshot(); len(elts) != 1 || elts[0].Key != k(`later`) {
+		t.Errorf(`Loaded %v, expected only later.`, elts)
+	}
+	l.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if _, ret := l.Get(k(`later`)); ret != 404 {
+		t.Errorf(`Loaded item outlived its deadline, got %d.`, ret)
+	}
+}
+
+func TestLoadLegacy(t *testing.T) {
+	// What the service wrote before the cache package: the values, then
+	// the read counts, keyed by whatever Go type the key had.
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	enc.Encode(map[interface{}]interface{}{`foo`: `bar`, 123: `Integer`, false: `Boolean`, `n`: 1.5})
+	enc.Encode(map[interface{}]int{`foo`: DefaultMaxReads - 1})
+
+	s := New(Options{})
+	if err := s.Load(&buf); err != nil {
+		t.Fatalf(`Load failed: %v`, err)
+	}
+	for key, want := range map[Key]interface{}{k(`foo`): `bar`, NumberKey(123): `Integer`, BoolKey(false): `Boolean`, k(`n`): 1.5} {
+		if elt, ret := s.Get(key); ret != 200 || elt.Value != want || elt.Version == 0 {
+			t.Errorf(`Legacy item %v is %v, %d; expected %v.`, key, elt.Value, ret, want)
+		}
+	}
+	if _, ret := s.Get(k(`foo`)); ret != 404 {
+		t.Errorf(`Legacy read count was not restored.`)
+	}
+	if err := s.Load(bytes.NewReader([]byte(`garbage`))); err == nil {
+		t.Errorf(`Loading garbage succeeded.`)
+	}
+}
+
+func TestEvictLRU(t *testing.T) {
+	s := New(Options{Shards: 1, MaxItems: 3})
+	for _, v := range []string{`a`, `b`, `c`} {
+		s.Create(k(v), v, Meta{})
+	}
+	// Touch a so that b becomes the least recently used.
+	s.Get(k(`a`))
+	s.Create(k(`d`), `d`, Meta{})
+
+	if _, ret := s.Get(k(`b`)); ret != 404 {
+		t.Errorf(`Least recently used item survived, got %d.`, ret)
+	}
+	for _, v := range []string{`a`, `c`, `d`} {
+		if _, ret := s.Get(k(v)); ret != 200 {
+			t.Errorf(`Get(%s) returned %d, expected 200.`, v, ret)
+		}
+	}
+	if st := s.Stats(); st.Items != 3 || st.Evictions != 1 {
+		t.Errorf(`Stats are %+v, expected 3 items and 1 eviction.`, st)
+	}
+}
+
+func TestEvictBytes(t *testing.T) {
+	s := New(Options{Shards: 1, MaxBytes: 4096})
+	big := string(make([]byte, 1000))
+	for i := 0; i < 10; i++ {
+		s.Create(k(float64(i)), big, Meta{})
+	}
+	st := s.Stats()
+	if st.Bytes > 4096 || st.Items == 0 || st.Evictions == 0 {
+		t.Errorf(`Stats are %+v, expected to stay within 4096 bytes.`, st)
+	}
+
+	// Growing an item through Update is accounted for too.
+	s.Update(k(9.0), big+big+big, Meta{}, Cond{})
+	if st := s.Stats(); st.Bytes > 4096 {
+		t.Errorf(`Update took the store to %d bytes.`, st.Bytes)
+	}
+
+	s.Clear()
+	if st := s.Stats(); st.Bytes != 0 || st.Items != 0 {
+		t.Errorf(`Stats are %+v after Clear, expected zero.`, st)
+	}
+}
+
+func TestEvictAcrossShards(t *testing.T) {
+	// Capacity bounds the whole store, however keys spread over the
+	// default number of shards.
+	s := New(Options{MaxItems: 100})
+	for i := 0; i < 100; i++ {
+		s.Create(k(float64(i)), i, Meta{})
+	}
+	if st := s.Stats(); st.Items != 100 || st.Evictions != 0 {
+		t.Errorf(`Stats are %+v, expected 100 items and no evictions.`, st)
+	}
+	s.Get(k(0.0))
+	for i := 100; i < 110; i++ {
+		s.Create(k(float64(i)), i, Meta{})
+	}
+	if st := s.Stats(); st.Items != 100 || st.Evictions != 10 {
+		t.Errorf(`Stats are %+v, expected 100 items and 10 evictions.`, st)
+	}
+	for i := 0; i < 110; i++ {
+		// 0 was read, so 1 to 10 were the least recently used.
+		want := 200
+		if i >= 1 && i <= 10 {
+			want = 404
+		}
+		if _, ret := s.Get(k(float64(i))); ret != want {
+			t.Errorf(`Get(%d) returned %d, expected %d.`, i, ret, want)
+		}
+	}
+
+	s = New(Options{MaxItems: 10})
+	for i := 0; i < 64; i++ {
+		s.Create(k(float64(i)), i, Meta{})
+	}
+	if st := s.Stats(); st.Items != 10 {
+		t.Errorf(`Store bounded to 10 items holds %d.`, st.Items)
+	}
+
+	s = New(Options{MaxBytes: 64 << 10})
+	big := string(make([]byte, 1000))
+	for i := 0; i < 200; i++ {
+		s.Create(k(float64(i)), big, Meta{})
+	}
+	if st := s.Stats(); st.Bytes > 64<<10 || st.Bytes < 60<<10 {
+		t.Errorf(`Store bounded to 64 KiB holds %d bytes.`, st.Bytes)
+	}
+}
+
+func TestItemReadLimit(t *testing.T) {
+	s := New(Options{MaxReads: 3})
+	s.Create(k(`token`), `secret`, Meta{MaxReads: 1})
+	s.Create(k(`ref`), `data`, Meta{MaxReads: Unlimited})
+	s.Create(k(`plain`), `data`, Meta{})
+
+	if _, ret := s.Get(k(`token`)); ret != 200 {
+		t.Errorf(`First read of token returned %d, expected 200.`, ret)
+	}
+	if _, ret := s.Get(k(`token`)); ret != 404 {
+		t.Errorf(`Second read of token returned %d, expected 404.`, ret)
+	}
+	for i := 0; i < 3; i++ {
+		s.Get(k(`plain`))
+	}
+	if _, ret := s.Get(k(`plain`)); ret != 404 {
+		t.Errorf(`Store default limit was not applied, got %d.`, ret)
+	}
+	for i := 0; i < 2*DefaultMaxReads; i++ {
+		if _, ret := s.Get(k(`ref`)); ret != 200 {
+			t.Fatalf(`Read %d of unlimited item returned %d.`, i+1, ret)
+		}
+	}
+
+	// Lowering the limit below the reads already made purges on the next
+	// read.
+	s.Update(k(`ref`), `data`, Meta{MaxReads: 5}, Cond{})
+	if _, ret := s.Get(k(`ref`)); ret != 200 {
+		t.Errorf(`Read after lowering the limit returned %d, expected 200.`, ret)
+	}
+	if _, ret := s.Get(k(`ref`)); ret != 404 {
+		t.Errorf(`Item outlived its lowered limit, got %d.`, ret)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	s := New(Options{})
+	v1, _ := s.Create(k(`foo`), `bar`, Meta{})
+	v2, ret := s.Update(k(`foo`), `baz`, Meta{}, Cond{IfMatch: []uint64{v1}})
+	if ret != 204 || v2 <= v1 {
+		t.Fatalf(`Update returned %d, %d; expected 204 and a version past %d.`, v2, ret, v1)
+	}
+	if elt, _ := s.Get(k(`foo`)); elt.Version != v2 {
+		t.Errorf(`Get returned version %d, expected %d.`, elt.Version, v2)
+	}
+
+	// A lost update: the first writer's version is stale now.
+	if _, ret := s.Update(k(`foo`), `lost`, Meta{}, Cond{IfMatch: []uint64{v1}}); ret != 412 {
+		t.Errorf(`Stale If-Match returned %d, expected 412.`, ret)
+	}
+	if ret := s.Delete(k(`foo`), Cond{IfNoneMatch: []uint64{Any}}); ret != 412 {
+		t.Errorf(`If-None-Match * on an existing item returned %d, expected 412.`, ret)
+	}
+	if _, ret := s.Update(k(`nope`), `x`, Meta{}, Cond{IfMatch: []uint64{Any}}); ret != 412 {
+		t.Errorf(`If-Match * on a missing item returned %d, expected 412.`, ret)
+	}
+	if _, ret := s.Update(k(`foo`), `x`, Meta{}, Cond{IfMatch: []uint64{}}); ret != 412 {
+		t.Errorf(`Empty If-Match returned %d, expected 412.`, ret)
+	}
+	if ret := s.Delete(k(`foo`), Cond{IfMatch: []uint64{v1, v2}}); ret != 204 {
+		t.Errorf(`Delete with a matching version returned %d, expected 204.`, ret)
+	}
+
+	// Versions carry on from where they were after a restart.
+	var buf bytes.Buffer
+	s.Save(&buf)
+	l := New(Options{})
+	l.Load(&buf)
+	if v3, _ := l.Create(k(`foo`), `new`, Meta{}); v3 <= v2 {
+		t.Errorf(`Version %d was handed out after a restart, expected more than %d.`, v3, v2)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	s := New(Options{})
+	s.Create(k(`n`), 1.5, Meta{})
+	s.Create(k(`s`), `one`, Meta{})
+
+	if elt, ret, _ := s.Modify(k(`n`), Cond{}, Incr(2, false)); ret != 200 || elt.Value != 3.5 {
+		t.Errorf(`Incr returned %v, %d; expected 3.5, 200.`, elt.Value, ret)
+	}
+	if _, ret, err := s.Modify(k(`s`), Cond{}, Incr(1, true)); ret != 409 || err == nil {
+		t.Errorf(`Incr of a string returned %d, %v; expected 409 and an error.`, ret, err)
+	}
+	if _, ret, _ := s.Modify(k(`new`), Cond{}, Incr(1, false)); ret != 404 {
+		t.Errorf(`Incr of a missing item returned %d, expected 404.`, ret)
+	}
+	if elt, ret, _ := s.Modify(k(`new`), Cond{}, Incr(-1, true)); ret != 201 || elt.Value != -1.0 {
+		t.Errorf(`Creating Incr returned %v, %d; expected -1, 201.`, elt.Value, ret)
+	}
+
+	// Concurrent increments are not lost.
+	done := make(chan bool)
+	for i := 0; i < 100; i++ {
+		go func() {
+			s.Modify(k(`n`), Cond{}, Incr(1, false))
+			done <- true
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		<-done
+	}
+	if elt, _ := s.Peek(k(`n`)); elt.Value != 103.5 {
+		t.Errorf(`Value after concurrent increments is %v, expected 103.5.`, elt.Value)
+	}
+}
+
+func TestSaveLoadNested(t *testing.T) {
+	const doc = `{"a":{"b":{"c":[1,"two",true,null,{"d":[[],[{}],{"e":{}}]}]}},"f":[],"g":{},"h":null,"i":-0.5}`
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatal(err)
+	}
+	s := New(Options{})
+	s.Create(k(`doc`), v, Meta{})
+	s.Create(k(`list`), []interface{}{v, []interface{}{v}}, Meta{})
+
+	var buf bytes.Buffer
+	if _, err := s.Save(&buf); err != nil {
+		t.Fatalf(`Save failed: %v`, err)
+	}
+	l := New(Options{})
+	if err := l.Load(&buf); err != nil {
+		t.Fatalf(`Load failed: %v`, err)
+	}
+
+	elt, _ := l.Get(k(`doc`))
+	if b, _ := json.Marshal(elt.Value); string(b) != doc {
+		t.Errorf(`Nested value came back as %s, expected %s.`, b, doc)
+	}
+	elt, _ = l.Get(k(`list`))
+	if b, _ := json.Marshal(elt.Value); string(b) != `[`+doc+`,[`+doc+`]]` {
+		t.Errorf(`Nested array came back as %s.`, b)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s := New(Options{})
+	s.Create(k(`a`), 1.0, Meta{})
+	s.Create(k(`b`), 2.0, Meta{})
+
+	res := s.Batch([]Op{
+		{Op: OpCreate, Key: k(`c`), Value: 3.0},
+		{Op: OpCreate, Key: k(`a`), Value: 0.0},
+		{Op: OpUpdate, Key: k(`b`), Value: 20.0},
+		{Op: OpUpdate, Key: k(`x`), Value: 0.0},
+		{Op: OpUpsert, Key: k(`a`), Value: 10.0},
+		{Op: OpUpsert, Key: k(`d`), Value: 4.0},
+		{Op: OpDelete, Key: k(`c`)},
+		{Op: OpGet, Key: k(`d`)},
+		{Op: `frob`, Key: k(`d`)},
+	}, false)
+	want := []int{201, 409, 204, 404, 204, 201, 204, 200, 406}
+	for i, r := range res {
+		if r.Status != want[i] {
+			t.Errorf(`Op %d returned %d, expected %d.`, i, r.Status, want[i])
+		}
+	}
+	if res[7].Elt.Value != 4.0 || res[7].Elt.Version != res[5].Elt.Version {
+		t.Errorf(`Get in batch returned %+v.`, res[7].Elt)
+	}
+	for key, v := range map[string]interface{}{`a`: 10.0, `b`: 20.0, `d`: 4.0} {
+		if elt, _ := s.Peek(k(key)); elt.Value != v {
+			t.Errorf(`%s is %v after batch, expected %v.`, key, elt.Value, v)
+		}
+	}
+}
+
+func TestBatchAtomic(t *testing.T) {
+	s := New(Options{Shards: 1, MaxItems: 3, MaxReads: 1})
+	s.Create(k(`a`), 1.0, Meta{})
+	s.Create(k(`b`), 2.0, Meta{})
+	s.Create(k(`c`), 3.0, Meta{})
+	before := s.Snapshot()
+
+	res := s.Batch([]Op{
+		{Op: OpUpdate, Key: k(`a`), Value: 10.0},
+		{Op: OpDelete, Key: k(`b`)},
+		{Op: OpGet, Key: k(`c`)}, // Its last read.
+		{Op: OpCreate, Key: k(`d`), Value: 4.0},
+		{Op: OpCreate, Key: k(`e`), Value: 5.0},
+		{Op: OpCreate, Key: k(`a`), Value: 0.0},
+	}, true)
+	want := []int{424, 424, 424, 424, 424, 409}
+	for i, r := range res {
+		if r.Status != want[i] {
+			t.Errorf(`Op %d returned %d, expected %d.`, i, r.Status, want[i])
+		}
+	}
+	after := s.Snapshot()
+	sort.Slice(before, func(i, j int) bool { return before[i].Key.Text < before[j].Key.Text })
+	sort.Slice(after, func(i, j int) bool { return after[i].Key.Text < after[j].Key.Text })
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf(`Failed batch left %v, expected %v.`, after, before)
+	}
+	if st := s.Stats(); st.Evictions != 0 {
+		t.Errorf(`Failed batch evicted %d items.`, st.Evictions)
+	}
+	if _, ret := s.Get(k(`c`)); ret != 200 {
+		t.Errorf(`Failed batch counted a read.`)
+	}
+
+	res = s.Batch([]Op{
+		{Op: OpUpdate, Key: k(`a`), Value: 10.0},
+		{Op: OpCreate, Key: k(`c`), Value: 30.0},
+		{Op: OpDelete, Key: k(`b`)},
+	}, true)
+	for i, r := range res {
+		if r.Status >= 300 {
+			t.Errorf(`Op %d returned %d.`, i, r.Status)
+		}
+	}
+	if n := len(s.Snapshot()); n != 2 {
+		t.Errorf(`%d items after batch, expected 2.`, n)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	s := New(Options{})
+	va, _ := s.Create(k(`a`), `token`, Meta{})
+	s.Create(k(`n`), map[string]interface{}{`x`: []interface{}{1.0}}, Meta{})
+	move := []Op{
+		{Op: OpDelete, Key: k(`a`)},
+		{Op: OpCreate, Key: k(`b`), Value: `token`},
+	}
+
+	failed, res := s.Txn([]Check{
+		{Key: k(`a`), Exists: true, Value: `token`, HasValue: true, Version: va},
+		{Key: k(`b`)},
+		{Key: k(`n`), Exists: true, Value: map[string]interface{}{`x`: []interface{}{2.0}}, HasValue: true},
+		{Key: k(`a`), Exists: true, Version: va + 100},
+		{Key: k(`c`), Exists: true},
+	}, move)
+	if !reflect.DeepEqual(failed, []int{2, 3, 4}) {
+		t.Errorf(`Failed checks are %v, expected [2 3 4].`, failed)
+	}
+	for i, r := range res {
+		if r.Status != 424 {
+			t.Errorf(`Op %d returned %d after failed checks, expected 424.`, i, r.Status)
+		}
+	}
+	if _, ret := s.Peek(k(`a`)); ret != 200 {
+		t.Errorf(`Failed transaction deleted a.`)
+	}
+
+	failed, res = s.Txn([]Check{
+		{Key: k(`a`), Exists: true, Value: `token`, HasValue: true, Version: va},
+		{Key: k(`b`)},
+		{Key: k(`n`), Exists: true, Value: map[string]interface{}{`x`: []interface{}{1.0}}, HasValue: true},
+	}, move)
+	if failed != nil || res[0].Status != 204 || res[1].Status != 201 {
+		t.Errorf(`Transaction returned %v, %v.`, failed, res)
+	}
+	if elt, ret := s.Peek(k(`b`)); ret != 200 || elt.Value != `token` {
+		t.Errorf(`Token wasn't moved: %v, %d.`, elt, ret)
+	}
+
+	// Failing ops roll the transaction back as well.
+	failed, res = s.Txn(nil, []Op{
+		{Op: OpDelete, Key: k(`b`)},
+		{Op: OpCreate, Key: k(`n`), Value: `token`},
+	})
+	if failed != nil || res[0].Status != 424 || res[1].Status != 409 {
+		t.Errorf(`Transaction returned %v, %v.`, failed, res)
+	}
+	if _, ret := s.Peek(k(`b`)); ret != 200 {
+		t.Errorf(`Failed transaction deleted b.`)
+	}
+}
+
+func TestList(t *testing.T) {
+	s := New(Options{})
+	for _, v := range []interface{}{`b`, `a`, `ab`, 10, 9, -1.5, true, false, `10`} {
+		s.Create(k(v), v, Meta{})
+	}
+	keys := func(elts []Elt) (ks []string) {
+		for _, elt := range elts {
+			ks = append(ks, elt.Key.String())
+		}
+		return
+	}
+
+	all, more := s.List(ListOptions{Order: ByKey})
+	want := []string{`string:10`, `string:a`, `string:ab`, `string:b`, `number:-1.5`, `number:9`, `number:10`, `bool:false`, `bool:true`}
+	if !reflect.DeepEqual(keys(all), want) || more {
+		t.Errorf(`Listed %v, %v; expected %v.`, keys(all), more, want)
+	}
+
+	// Paging through yields every item once, in order.
+	var paged []Elt
+	o := ListOptions{Order: ByKey, Desc: true, Limit: 4}
+	for {
+		page, more := s.List(o)
+		paged = append(paged, page...)
+		if !more {
+			break
+		}
+		o.After = &page[len(page)-1]
+	}
+	for i, j := 0, len(paged)-1; i < j; i, j = i+1, j-1 {
+		paged[i], paged[j] = paged[j], paged[i]
+	}
+	if !reflect.DeepEqual(keys(paged), want) {
+		t.Errorf(`Paged through %v, expected %v reversed.`, keys(paged), want)
+	}
+
+	if elts, _ := s.List(ListOptions{Order: ByKey, Prefix: `a`}); !reflect.DeepEqual(keys(elts), []string{`string:a`, `string:ab`}) {
+		t.Errorf(`Listed %v with prefix a.`, keys(elts))
+	}
+	if elts, _ := s.List(ListOptions{Order: ByKey, Prefix: `1`, Kind: Number}); !reflect.DeepEqual(keys(elts), []string{`number:10`}) {
+		t.Errorf(`Listed %v with prefix 1 and kind number.`, keys(elts))
+	}
+
+	s.Update(k(`b`), `new`, Meta{}, Cond{})
+	if elts, _ := s.List(ListOptions{Order: ByVersion, Desc: true, Limit: 1}); elts[0].Key != k(`b`) {
+		t.Errorf(`Last changed item is %v, expected b.`, elts[0].Key)
+	}
+
+	// Pages of a large store come out whole and in order.
+	s = New(Options{})
+	for i := 0; i < 300; i++ {
+		s.Create(k(i), float64(i), Meta{})
+	}
+	o = ListOptions{Order: ByVersion, Limit: 7}
+	for n := 0; ; {
+		page, more := s.List(o)
+		for _, elt := range page {
+			if elt.Value != float64(n) {
+				t.Fatalf(`Item %d of the listing is %v.`, n, elt.Value)
+			}
+			n++
+		}
+		if !more {
+			if n != 300 {
+				t.Errorf(`Paged through %d items, expected 300.`, n)
+			}
+			break
+		}
+		o.After = &page[len(page)-1]
+	}
+}
+
+func TestExport(t *testing.T) {
+	s := New(Options{})
+	for i := 0; i < 100; i++ {
+		s.Create(k(i), float64(i), Meta{})
+	}
+	sum := 0.0
+	if err := s.Export(func(elt Elt) error {
+		sum += elt.Value.(float64)
+		s.Delete(elt.Key, Cond{}) // Writers aren't held up by the export.
+		return nil
+	}); err != nil || sum != 4950 {
+		t.Errorf(`Export returned %v and values adding up to %v, expected 4950.`, err, sum)
+	}
+
+	s.Create(k(`a`), 1.0, Meta{})
+	s.Create(k(`b`), 2.0, Meta{})
+	n, stop := 0, fmt.Errorf(`stop`)
+	if err := s.Export(func(Elt) error { n++; return stop }); err != stop || n != 1 {
+		t.Errorf(`Export returned %v after %d items, expected to stop after 1.`, err, n)
+	}
+
+	// An item moved back and forth between shards shows up exactly once.
+	s = New(Options{})
+	from, to := k(0), k(1)
+	for i := 2; s.shardIndex(from) == s.shardIndex(to); i++ {
+		to = k(i)
+	}
+	s.Create(from, 1.0, Meta{})
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				s.Txn(nil, []Op{{Op: OpDelete, Key: from}, {Op: OpCreate, Key: to, Value: 1.0}})
+				from, to = to, from
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		n := 0
+		s.Export(func(Elt) error { n++; return nil })
+		if n != 1 {
+			t.Errorf(`Export saw the moved item %d times, expected once.`, n)
+			break
+		}
+	}
+	close(done)
+}
+
+func TestTags(t *testing.T) {
+	s := New(Options{Shards: 4, MaxItems: 4})
+	s.Create(k(`a`), 1.0, Meta{Tags: []string{`user:1`, `page`}})
+	s.Create(k(`b`), 2.0, Meta{Tags: []string{`user:1`}})
+	s.Create(k(`c`), 3.0, Meta{Tags: []string{`user:2`}})
+	s.Create(k(`d`), 4.0, Meta{})
+	s.Update(k(`c`), 3.0, Meta{Tags: []string{`user:1`}}, Cond{})
+	s.Update(k(`b`), 2.0, Meta{}, Cond{}) // Tags are left alone.
+
+	tagged := func(s Store, tag string) (ks []string) {
+		for _, elt := range s.Tagged(tag) {
+			ks = append(ks, elt.Key.Text)
+		}
+		return
+	}
+	if ks := tagged(s, `user:1`); !reflect.DeepEqual(ks, []string{`a`, `b`, `c`}) {
+		t.Errorf(`Tagged user:1 are %v, expected [a b c].`, ks)
+	}
+	if ks := tagged(s, `user:2`); ks != nil {
+		t.Errorf(`Tagged user:2 are %v, expected none.`, ks)
+	}
+
+	var buf bytes.Buffer
+	s.Save(&buf)
+	l := New(Options{})
+	if err := l.Load(&buf); err != nil {
+		t.Fatalf(`Load failed: %v`, err)
+	}
+	if elt, _ := l.Peek(k(`a`)); !reflect.DeepEqual(elt.Tags, []string{`user:1`, `page`}) {
+		t.Errorf(`Tags of a were loaded as %v.`, elt.Tags)
+	}
+	if n := l.DeleteTagged(`user:1`); n != 3 {
+		t.Errorf(`Deleted %d items tagged user:1, expected 3.`, n)
+	}
+	if ks := tagged(l, `page`); ks != nil {
+		t.Errorf(`Tagged page are %v after deleting a.`, ks)
+	}
+	if n := len(l.Snapshot()); n != 1 {
+		t.Errorf(`%d items left, expected 1.`, n)
+	}
+
+	// Evicted items leave the index.
+	s = New(Options{Shards: 1, MaxItems: 1})
+	s.Create(k(`a`), 1.0, Meta{Tags: []string{`x`}})
+	s.Create(k(`b`), 2.0, Meta{})
+	if ks := tagged(s, `x`); ks != nil || len(s.shards[0].tags) != 0 {
+		t.Errorf(`Evicted item is still tagged: %v.`, ks)
+	}
+}
+
+func TestRename(t *testing.T) {
+	s := New(Options{MaxReads: 3})
+	v, _ := s.Create(k(`old`), 1.0, Meta{Tags: []string{`t`}})
+	s.Create(k(`taken`), 2.0, Meta{})
+	s.Get(k(`old`))
+
+	if _, ret := s.Rename(k(`old`), k(`taken`), 3.0, Meta{}, Cond{}); ret != 409 {
+		t.Errorf(`Rename onto an existing key returned %d, expected 409.`, ret)
+	}
+	if _, ret := s.Rename(k(`nope`), k(`new`), 3.0, Meta{}, Cond{}); ret != 404 {
+		t.Errorf(`Rename of a missing key returned %d, expected 404.`, ret)
+	}
+	if _, ret := s.Rename(k(`old`), k(`new`), 3.0, Meta{}, Cond{IfMatch: []uint64{v + 100}}); ret != 412 {
+		t.Errorf(`Rename of a changed key returned %d, expected 412.`, ret)
+	}
+	if _, ret := s.Rename(k(`old`), k(1.0), 3.0, Meta{}, Cond{IfMatch: []uint64{v}}); ret != 204 {
+		t.Errorf(`Rename returned %d, expected 204.`, ret)
+	}
+
+	if _, ret := s.Peek(k(`old`)); ret != 404 {
+		t.Errorf(`Renamed item is still under its old key.`)
+	}
+	if elt, _ := s.Get(k(1.0)); elt.Value != 3.0 || !reflect.DeepEqual(elt.Tags, []string{`t`}) {
+		t.Errorf(`Renamed item is %+v.`, elt)
+	}
+	if elts := s.Tagged(`t`); len(elts) != 1 || elts[0].Key != k(1.0) {
+		t.Errorf(`Tag index lists %v after rename.`, elts)
+	}
+	// Its third read is the last.
+	if _, ret := s.Get(k(1.0)); ret != 200 {
+		t.Errorf(`Third read returned %d.`, ret)
+	}
+	if _, ret := s.Get(k(1.0)); ret != 404 {
+		t.Errorf(`Read count was not kept by rename.`)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	s := New(Options{})
+	v, ret := s.Upsert(k(`a`), 1.0, Meta{}, Cond{})
+	if ret != 201 {
+		t.Errorf(`Upsert of a missing key returned %d, expected 201.`, ret)
+	}
+	if _, ret = s.Upsert(k(`a`), 2.0, Meta{}, Cond{IfNoneMatch: []uint64{Any}}); ret != 412 {
+		t.Errorf(`Upsert with If-None-Match: * returned %d, expected 412.`, ret)
+	}
+	if _, ret = s.Upsert(k(`a`), 2.0, Meta{}, Cond{IfMatch: []uint64{v}}); ret != 204 {
+		t.Errorf(`Upsert of an existing key returned %d, expected 204.`, ret)
+	}
+	if _, ret = s.Upsert(k(`b`), 2.0, Meta{}, Cond{IfMatch: []uint64{Any}}); ret != 412 {
+		t.Errorf(`Upsert with If-Match: * of a missing key returned %d, expected 412.`, ret)
+	}
+	if elt, _ := s.Peek(k(`a`)); elt.Value != 2.0 {
+		t.Errorf(`Upserted value is %v, expected 2.`, elt.Value)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	now := time.Now()
+	s := New(Options{Retention: time.Hour})
+	s.now = func() time.Time { return now }
+	s.Create(k(`a`), 1.0, Meta{Tags: []string{`t`}})
+	s.Create(k(`b`), 2.0, Meta{Tags: []string{`t`}})
+	s.Create(k(`c`), 3.0, Meta{})
+	s.Get(k(`a`))
+
+	s.Delete(k(`a`), Cond{})
+	if _, ret := s.Get(k(`a`)); ret != 404 {
+		t.Errorf(`Get of a deleted item returned %d, expected 404.`, ret)
+	}
+	now = now.Add(time.Minute)
+	s.DeleteTagged(`t`)
+	now = now.Add(time.Minute)
+	s.Clear()
+	if ts := s.Tombstones(); len(ts) != 3 || ts[0].Key != k(`c`) || ts[2].Key != k(`a`) {
+		t.Errorf(`Tombstones are %v, expected c, b, a.`, ts)
+	}
+
+	// A failed transaction doesn't lose tombstones, nor make new ones.
+	s.Create(k(`c`), 30.0, Meta{})
+	s.Txn(nil, []Op{
+		{Op: OpDelete, Key: k(`c`)},
+		{Op: OpCreate, Key: k(`a`), Value: 10.0},
+		{Op: OpDelete, Key: k(`x`)},
+	})
+	if _, ret := s.Undelete(k(`c`)); ret != 409 {
+		t.Errorf(`Undelete of an existing key returned %d, expected 409.`, ret)
+	}
+
+	var buf bytes.Buffer
+	s.Save(&buf)
+	l := New(Options{Retention: time.Hour})
+	l.now = s.now
+	if err := l.Load(&buf); err != nil {
+		t.Fatalf(`Load failed: %v`, err)
+	}
+	elt, ret := l.Undelete(k(`a`))
+	if ret != 201 || elt.Value != 1.0 {
+		t.Errorf(`Undelete returned %v, %d; expected a, 201.`, elt, ret)
+	}
+	if _, ret := l.Undelete(k(`a`)); ret != 404 {
+		t.Errorf(`Second undelete returned %d, expected 404.`, ret)
+	}
+	if elts := l.Tagged(`t`); len(elts) != 1 {
+		t.Errorf(`Undeleted item isn't tagged: %v.`, elts)
+	}
+	// Reads carried over: one down, 99 to go.
+	for i := 2; i < DefaultMaxReads; i++ {
+		l.Get(k(`a`))
+	}
+	if _, ret := l.Get(k(`a`)); ret != 200 {
+		t.Errorf(`Undeleted item lost reads.`)
+	}
+	if _, ret := l.Get(k(`a`)); ret != 404 {
+		t.Errorf(`Undeleted item didn't keep its read count.`)
+	}
+
+	now = now.Add(time.Hour)
+	l.Sweep()
+	if st := l.Stats(); st.Tombstones != 0 {
+		t.Errorf(`%d tombstones left past retention.`, st.Tombstones)
+	}
+	if _, ret := l.Undelete(k(`b`)); ret != 404 {
+		t.Errorf(`Undelete past retention returned %d, expected 404.`, ret)
+	}
+
+	// Without retention, nothing is kept.
+	s = New(Options{})
+	s.Create(k(`a`), 1.0, Meta{})
+	s.Delete(k(`a`), Cond{})
+	if _, ret := s.Undelete(k(`a`)); ret != 404 || len(s.Tombstones()) != 0 {
+		t.Errorf(`Store without retention kept a tombstone.`)
+	}
+}
+
+func TestEvictTombstones(t *testing.T) {
+	now := time.Now()
+	s := New(Options{MaxItems: 3, Retention: time.Hour})
+	s.now = func() time.Time { return now }
+	for _, key := range []string{`a`, `b`, `c`} {
+		s.Create(k(key), key, Meta{})
+	}
+	s.Delete(k(`a`), Cond{})
+	now = now.Add(time.Minute)
+	s.Delete(k(`b`), Cond{})
+
+	// Tombstones take room; the oldest goes before any live item.
+	s.Create(k(`d`), `d`, Meta{})
+	if _, ret := s.Undelete(k(`a`)); ret != 404 {
+		t.Errorf(`Undelete of the oldest tombstone returned %d, expected 404.`, ret)
+	}
+	for _, key := range []string{`c`, `d`} {
+		if _, ret := s.Get(k(key)); ret != 200 {
+			t.Errorf(`Item %s was evicted before a tombstone.`, key)
+		}
+	}
+	if _, ret := s.Undelete(k(`b`)); ret != 201 {
+		t.Errorf(`Undelete of the newest tombstone returned %d, expected 201.`, ret)
+	}
+
+	// Deleting a lot keeps no more than fits.
+	for i := 0; i < 100; i++ {
+		s.Create(k(fmt.Sprint(i)), i, Meta{})
+		s.Delete(k(fmt.Sprint(i)), Cond{})
+	}
+	if st := s.Stats(); st.Items+st.Tombstones > 3 {
+		t.Errorf(`Store holds %d items and %d tombstones, expected 3 at most.`, st.Items, st.Tombstones)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	now := time.Now().Round(0)
+	created := now
+	s := New(Options{MaxReads: 5})
+	s.now = func() time.Time { return now }
+	s.Create(k(`a`), `value`, Meta{Tags: []string{`t`}})
+
+	now = now.Add(time.Minute)
+	s.Get(k(`a`))
+	read := now
+	now = now.Add(time.Minute)
+	v, _ := s.Update(k(`a`), `other`, Meta{}, Cond{})
+	now = now.Add(time.Minute)
+
+	info, ret := s.Describe(k(`a`))
+	want := Info{
+		Key:      k(`a`),
+		Version:  v,
+		Created:  created,
+		Updated:  created.Add(2 * time.Minute),
+		Read:     read,
+		Reads:    1,
+		MaxReads: 5,
+		Size:     entryOverhead + sizeOf(`a`) + sizeOf(`other`),
+		Tags:     []string{`t`},
+	}
+	if ret != 200 || !reflect.DeepEqual(info, want) {
+		t.Errorf(`Describe returned %+v, %d; expected %+v.`, info, ret, want)
+	}
+	if info, _ = s.Describe(k(`a`)); info.Reads != 1 {
+		t.Errorf(`Describe counted a read.`)
+	}
+
+	var buf bytes.Buffer
+	s.Save(&buf)
+	l := New(Options{MaxReads: 5})
+	l.Load(&buf)
+	if info, _ := l.Describe(k(`a`)); !info.Created.Equal(created) || !info.Read.Equal(read) {
+		t.Errorf(`Timestamps were loaded as %+v.`, info)
+	}
+	if _, ret := s.Describe(k(`b`)); ret != 404 {
+		t.Errorf(`Describe of a missing key returned %d, expected 404.`, ret)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	big := map[string]interface{}{`text`: strings.Repeat(`abc`, 400), `n`: 1.5}
+	s := New(Options{Compress: 100})
+	s.Create(k(`big`), big, Meta{})
+	s.Create(k(`small`), `short`, Meta{})
+
+	st := s.Stats()
+	if st.Compressed != 1 || st.CompressedBytes >= st.UncompressedBytes || st.Ratio <= 1 {
+		t.Errorf(`Stats are %+v; expected one value compressed.`, st)
+	}
+	if elt, _ := s.Get(k(`big`)); !reflect.DeepEqual(elt.Value, big) {
+		t.Errorf(`Compressed value came back as %v.`, elt.Value)
+	}
+	if elt, _ := s.Get(k(`small`)); elt.Value != `short` {
+		t.Errorf(`Small value came back as %v.`, elt.Value)
+	}
+	if _, ret, _ := s.Modify(k(`big`), Cond{}, MergePatch(map[string]interface{}{`n`: nil})); ret != 200 {
+		t.Errorf(`Patching a compressed value returned %d.`, ret)
+	}
+	if elt, _ := s.Get(k(`big`)); !reflect.DeepEqual(elt.Value, map[string]interface{}{`text`: big[`text`]}) {
+		t.Errorf(`Patched value came back as %v.`, elt.Value)
+	}
+
+	// Snapshots hold the compressed values, which a store not compressing
+	// unpacks again.
+	var buf bytes.Buffer
+	s.Save(&buf)
+	l := New(Options{})
+	l.Load(&buf)
+	if st := l.Stats(); st.Compressed != 0 || st.Items != 2 {
+		t.Errorf(`Loaded stats are %+v; expected nothing compressed.`, st)
+	}
+	if elt, _ := l.Get(k(`big`)); !reflect.DeepEqual(elt.Value, map[string]interface{}{`text`: big[`text`]}) {
+		t.Errorf(`Loaded value came back as %v.`, elt.Value)
+	}
+
+	s.Delete(k(`big`), Cond{})
+	if st := s.Stats(); st.Compressed != 0 || st.CompressedBytes != 0 {
+		t.Errorf(`Stats after delete are %+v.`, st)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	now := time.Now().Round(0)
+	o := Options{MaxItems: 1000, Retention: time.Hour}
+	s := New(o)
+	s.now = func() time.Time { return now }
+	var log bytes.Buffer
+	s.Journal(&log)
+
+	s.Create(k(`a`), `one`, Meta{Tags: []string{`t`}})
+	s.Create(k(`b`), `two`, Meta{})
+	s.Create(k(`c`), `three`, Meta{MaxReads: 2})
+	s.Update(k(`a`), `uno`, Meta{}, Cond{})
+	s.Get(k(`a`))
+	s.Get(k(`c`))
+	s.Get(k(`c`)) // Used up.
+	s.Delete(k(`b`), Cond{})
+	s.Rename(k(`a`), k(`d`), `dos`, Meta{}, Cond{})
+	s.Txn(nil, []Op{{Op: OpCreate, Key: k(`e`), Value: 1}, {Op: OpCreate, Key: k(`d`), Value: 2}})
+
+	// A snapshot taken after starting a new journal halfway through, as
+	// when compacting, replays to the same state as the whole journal.
+	var rest, snap bytes.Buffer
+	half := log.Len()
+	s.Journal(io.MultiWriter(&log, &rest))
+	s.Create(k(`e`), 1, Meta{})
+	s.Save(&snap)
+	s.Create(k(`f`), `five`, Meta{})
+	s.Clear()
+	s.Create(k(`g`), `six`, Meta{})
+	s.Undelete(k(`f`))
+	s.Get(k(`g`))
+
+	l := New(o)
+	if n, err := l.Replay(bytes.NewReader(log.Bytes()[:half])); err != nil || n == 0 {
+		t.Fatalf(`Replay returned %d, %v.`, n, err)
+	}
+	if n, err := l.Replay(bytes.NewReader(log.Bytes()[half:])); err != nil || n == 0 {
+		t.Fatalf(`Replay returned %d, %v.`, n, err)
+	}
+	m := New(o)
+	m.Load(&snap)
+	m.Replay(&rest)
+
+	for _, r := range []*Sharded{l, m} {
+		got, _ := r.List(ListOptions{Order: ByKey})
+		want, _ := s.List(ListOptions{Order: ByKey})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf(`Replayed items are %v; expected %v.`, got, want)
+		}
+		if !reflect.DeepEqual(r.Tombstones(), s.Tombstones()) {
+			t.Errorf(`Replayed tombstones are %v; expected %v.`, r.Tombstones(), s.Tombstones())
+		}
+		if info, _ := r.Describe(k(`g`)); info.Reads != 1 {
+			t.Errorf(`Replayed read count is %d.`, info.Reads)
+		}
+		if v, _ := r.Create(k(`h`), 0, Meta{}); v <= atomic.LoadUint64(&s.version) {
+			t.Errorf(`Replayed store handed out version %d again.`, v)
+		}
+	}
+
+	// A record cut short ends the replay with an error, keeping what came
+	// before it.
+	l = New(o)
+	if n, err := l.Replay(bytes.NewReader(log.Bytes()[:half-3])); err == nil || n == 0 {
+		t.Errorf(`Replaying a torn journal returned %d, %v.`, n, err)
+	}
+
+	// Nor is a change to several items ever replayed in part.
+	s = New(o)
+	log.Reset()
+	s.Journal(&log)
+	s.Create(k(`a`), `moved`, Meta{})
+	before := log.Len()
+	s.Txn([]Check{{Key: k(`a`), Exists: true}, {Key: k(`b`)}}, []Op{
+		{Op: OpDelete, Key: k(`a`)},
+		{Op: OpCreate, Key: k(`b`), Value: `moved`},
+	})
+	for cut := before; cut < log.Len(); cut++ {
+		l = New(o)
+		l.Replay(bytes.NewReader(log.Bytes()[:cut]))
+		if _, ret := l.Get(k(`a`)); ret != 200 || len(l.Snapshot()) != 1 {
+			t.Fatalf(`Replaying a journal cut at %d of %d left %v.`, cut, log.Len(), l.Snapshot())
+		}
+	}
+}
+
+// slow takes a while over every Write, as a disk syncing each would.
+type slow struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *slow) Write(b []byte) (int, error) {
+	w.writes++
+	time.Sleep(time.Millisecond)
+	return w.Buffer.Write(b)
+}
+
+func TestJournalConcurrent(t *testing.T) {
+	s := New(Options{})
+	var log slow
+	s.Journal(&log)
+	done := make(chan bool)
+	for g := 0; g < 8; g++ {
+		go func(g int) {
+			for i := 0; i < 50; i++ {
+				s.Create(k(float64(g*50+i)), i, Meta{})
+			}
+			done <- true
+		}(g)
+	}
+	for g := 0; g < 8; g++ {
+		<-done
+	}
+
+	// Changes made meanwhile share writes, and all of them are recorded.
+	if log.writes >= 400 {
+		t.Errorf(`Journaling 400 changes took %d writes.`, log.writes)
+	}
+	l := New(Options{})
+	if n, err := l.Replay(&log.Buffer); err != nil || n != 400 {
+		t.Errorf(`Replay returned %d, %v; expected 400, nil.`, n, err)
+	}
+	got, _ := l.List(ListOptions{Order: ByKey})
+	want, _ := s.List(ListOptions{Order: ByKey})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf(`Replayed %d items; expected %d.`, len(got), len(want))
+	}
+}
+
+// torn writes half of what it is given, and fails, once broken.
+type torn struct {
+	bytes.Buffer
+	broken bool
+}
+
+func (w *torn) Write(b []byte) (int, error) {
+	if w.broken {
+		n, _ := w.Buffer.Write(b[:len(b)/2])
+		return n, fmt.Errorf(`disk full`)
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestJournalFailure(t *testing.T) {
+	s := New(Options{})
+	var log torn
+	s.Journal(&log)
+	s.Create(k(`a`), `one`, Meta{})
+	s.Create(k(`b`), `two`, Meta{})
+
+	// The changes a journal misses once a write fails are recorded, as
+	// they then stand, in the next one.
+	log.broken = true
+	s.Update(k(`a`), `uno`, Meta{}, Cond{})
+	s.Create(k(`c`), `three`, Meta{})
+	s.Delete(k(`b`), Cond{})
+	var next bytes.Buffer
+	s.Journal(&next)
+	s.Create(k(`d`), `four`, Meta{})
+
+	l := New(Options{})
+	if _, err := l.Replay(&log.Buffer); err == nil {
+		t.Errorf(`Replaying a journal cut short by a failed write succeeded.`)
+	}
+	l.Replay(&next)
+	got, _ := l.List(ListOptions{Order: ByKey})
+	want, _ := s.List(ListOptions{Order: ByKey})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf(`Replayed items are %v; expected %v.`, got, want)
+	}
+
+	// So is a Clear, ahead of the rest.
+	log = torn{broken: true}
+	s.Journal(&log)
+	s.Create(k(`e`), `five`, Meta{})
+	s.Clear()
+	s.Create(k(`f`), `six`, Meta{})
+	next.Reset()
+	s.Journal(&next)
+	l.Replay(&next)
+	if got, _ := l.List(ListOptions{Order: ByKey}); len(got) != 1 || got[0].Key != k(`f`) {
+		t.Errorf(`Replayed items are %v; expected only f.`, got)
+	}
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	`sort`
+)
+
+// lockAll locks every shard, in index order as lock does.
+func (s *Sharded) lockAll() {
+	for _, sh := range s.shards {
+		sh.Lock()
+	}
+	for _, sh := range s.shards {
+		sh.preserve()
+	}
+}
+
+// unlockAll unlocks every shard, then journals whatever changed.
+func (s *Sharded) unlockAll() {
+	s.unlock(s.shards)
+}
+
+func (s *Sharded) Tagged(tag string) []Elt {
+	var c []listed
+	now := s.now()
+	s.lockAll()
+	for _, sh := range s.shards {
+		for k := range sh.tags[tag] {
+			if e := sh.items[k]; !e.expired(now) {
+				c = append(c, listed{Elt{Key: k}, *e})
+			}
+		}
+	}
+	s.unlockAll()
+	sort.Slice(c, func(i, j int) bool { return Compare(c[i].ref.Key, c[j].ref.Key) < 0 })
+	elts := make([]Elt, len(c))
+	for i := range c {
+		elts[i] = c[i].e.elt(c[i].ref.Key)
+	}
+	return elts
+}
+
+func (s *Sharded) DeleteTagged(tag string) int {
+	n := 0
+	now := s.now()
+	s.lockAll()
+	defer s.unlockAll()
+	for _, sh := range s.shards {
+		for k := range sh.tags[tag] {
+			if e := sh.items[k]; e.expired(now) {
+				sh.remove(k, e)
+				sh.expirations++
+			} else {
+				sh.bury(k, e, now)
+				n++
+			}
+		}
+	}
+	return n
+}
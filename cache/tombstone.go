@@ -0,0 +1,112 @@
+package cache
+
+import (
+	`container/list`
+	`sort`
+	`time`
+)
+
+// grave is a tombstone as held in a shard and written by Save.
+type grave struct {
+	Entry   entry
+	Deleted time.Time
+
+	size int64
+	elem *list.Element
+}
+
+// bury removes an entry, keeping it as a tombstone if the shard retains
+// deleted items.
+func (sh *shard) bury(k Key, e *entry, now time.Time) {
+	sh.remove(k, e)
+	if sh.retention > 0 {
+		sh.keep(k, &grave{Entry: *e, Deleted: now})
+	}
+}
+
+// keep holds g as the tombstone of k, in place of any it had. Tombstones
+// count against the store's capacity like items do.
+func (sh *shard) keep(k Key, g *grave) {
+	sh.forget(k)
+	g.size = entryOverhead + sizeOf(k.Text) + sizeOf(g.Entry.Value)
+	// They nearly always come in the order they were deleted.
+	at := sh.graves.Back()
+	for at != nil && sh.dead[at.Value.(Key)].Deleted.After(g.Deleted) {
+		at = at.Prev()
+	}
+	if at == nil {
+		g.elem = sh.graves.PushFront(k)
+	} else {
+		g.elem = sh.graves.InsertAfter(k, at)
+	}
+	sh.dead[k] = g
+	sh.charge(1, g.size)
+	sh.mark(k)
+}
+
+// forget drops the tombstone of k, if it has one.
+func (sh *shard) forget(k Key) {
+	g := sh.dead[k]
+	if g == nil {
+		return
+	}
+	sh.graves.Remove(g.elem)
+	delete(sh.dead, k)
+	sh.charge(-1, -g.size)
+	sh.mark(k)
+}
+
+// purge drops tombstones past retention.
+func (sh *shard) purge(now time.Time) {
+	for k, g := range sh.dead {
+		if now.Sub(g.Deleted) >= sh.retention {
+			sh.forget(k)
+		}
+	}
+}
+
+func (s *Sharded) Undelete(k Key) (Elt, int) {
+	defer s.evict()
+	sh := s.shardFor(k)
+	sh.Lock()
+	defer sh.Unlock()
+	now := s.now()
+	g := sh.dead[k]
+	if g == nil || now.Sub(g.Deleted) >= sh.retention {
+		return Elt{}, 404
+	}
+	if sh.lookup(k, now) != nil {
+		return Elt{}, 409
+	}
+	sh.forget(k)
+	e := g.Entry
+	if e.expired(now) {
+		return Elt{}, 404
+	}
+	s.bump(&e)
+	sh.add(k, &e)
+	return e.elt(k), 201
+}
+
+func (s *Sharded) Tombstones() []Tombstone {
+	// Values are only decompressed once the shards are unlocked.
+	var c []listed
+	var deleted []time.Time
+	now := s.now()
+	for _, sh := range s.shards {
+		sh.Lock()
+		for k, g := range sh.dead {
+			if now.Sub(g.Deleted) < sh.retention {
+				c = append(c, listed{Elt{Key: k}, g.Entry})
+				deleted = append(deleted, g.Deleted)
+			}
+		}
+		sh.Unlock()
+	}
+	ts := make([]Tombstone, len(c))
+	for i := range c {
+		ts[i] = Tombstone{c[i].e.elt(c[i].ref.Key), deleted[i]}
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Deleted.After(ts[j].Deleted) })
+	return ts
+}
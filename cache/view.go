@@ -0,0 +1,67 @@
+package cache
+
+import (
+	`time`
+)
+
+type (
+	// view is the store as it was when Export took it. Each shard is copied
+	// into it by whoever locks the shard first once the view is published:
+	// Export itself, or a writer about to change the shard.
+	view struct {
+		now   time.Time
+		parts map[*shard]*part // Fixed once published.
+	}
+
+	// part is one shard's share of a view, guarded by the shard's lock.
+	part struct {
+		done bool
+		c    []listed
+	}
+)
+
+// Lock locks the shard, first copying it into any view being taken.
+func (sh *shard) Lock() {
+	sh.Mutex.Lock()
+	sh.preserve()
+}
+
+// preserve copies the shard into the view being taken, unless it already
+// has been. It must be called with the shard locked, before changing it.
+func (sh *shard) preserve() {
+	v, _ := sh.view.Load().(*view)
+	if v == nil {
+		return
+	}
+	p := v.parts[sh]
+	if p.done {
+		return
+	}
+	p.done = true
+	for k, e := range sh.items {
+		if !e.expired(v.now) {
+			p.c = append(p.c, listed{Elt{Key: k}, *e})
+		}
+	}
+}
+
+// takeView copies every live entry as of now. Writers run meanwhile, but
+// one that locks a shard before it is copied copies it first, so the view
+// holds none of their changes. One locking several shards must call
+// preserve on each once it holds them all, so that it changes all of them
+// or none of them in the view.
+func (s *Sharded) takeView() *view {
+	s.viewing.Lock()
+	defer s.viewing.Unlock()
+	v := &view{now: s.now(), parts: make(map[*shard]*part, len(s.shards))}
+	for _, sh := range s.shards {
+		v.parts[sh] = &part{}
+	}
+	s.view.Store(v)
+	for _, sh := range s.shards {
+		sh.Lock()
+		sh.Unlock()
+	}
+	s.view.Store((*view)(nil))
+	return v
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`log`
+	`os`
+	`path/filepath`
+	`runtime`
+	`strconv`
+)
+
+var (
+	// dataDir holds every file the service writes; see openDataDir.
+	dataDir string
+	// lockFile is held open, and locked, for as long as the service runs.
+	lockFile *os.File
+)
+
+// config is what the -config file may set.
+type config struct {
+	DataDir string `json:"data_dir"`
+}
+
+// Where versions before the data directory kept their snapshot.
+const legacyFile = `/tmp/kirkwood.dat`
+
+// findDataDir picks the data directory: -data-dir if given, else data_dir
+// from the -config file, else $KIRKWOOD_DATA_DIR, else kirkwood in the
+// user's state directory, which unlike /tmp survives reboots. Flags come
+// first, since they are given explicitly.
+func findDataDir() (string, error) {
+	if *dataDirFlag != `` {
+		return *dataDirFlag, nil
+	}
+	if *configFile != `` {
+		b, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return ``, err
+		}
+		var c config
+		if err := json.Unmarshal(b, &c); err != nil {
+			return ``, fmt.Errorf(`%s: %v`, *configFile, err)
+		}
+		if c.DataDir != `` {
+			return c.DataDir, nil
+		}
+	}
+	if dir := os.Getenv(`KIRKWOOD_DATA_DIR`); dir != `` {
+		return dir, nil
+	}
+	if dir := os.Getenv(`XDG_STATE_HOME`); dir != `` {
+		return filepath.Join(dir, `kirkwood`), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ``, fmt.Errorf(`no data directory given, and %v`, err)
+	}
+	return filepath.Join(home, `.local`, `state`, `kirkwood`), nil
+}
+
+// openDataDir creates the data directory, readable by this user only, and
+// locks it, so that no two instances ever write the same files.
+func openDataDir() error {
+	dir, err := findDataDir()
+	if err != nil {
+		return err
+	}
+	if dataDir, err = filepath.Abs(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	if err := private(dataDir); err != nil {
+		return err
+	}
+	f, err := lockPath(dataFile(`kirkwood.lock`))
+	if err != nil {
+		return fmt.Errorf(`%s is in use by another instance: %v`, dataDir, err)
+	}
+	f.Truncate(0)
+	f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	lockFile = f
+	log.Printf(`Using %s.`, dataDir)
+	if _, err := os.Stat(dataFile(`kirkwood.dat`)); os.IsNotExist(err) {
+		if _, err := os.Stat(legacyFile); err == nil {
+			log.Printf(`Found %s, written by an earlier version. To restore it, stop the service and copy it to %s.`, legacyFile, dataFile(`kirkwood.dat`))
+		}
+	}
+	return nil
+}
+
+// private takes away whatever access other users have to dir, which may
+// have been there already, and the files in it. Windows has ACLs instead,
+// which are left alone.
+func private(dir string) error {
+	if runtime.GOOS == `windows` {
+		return nil
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if perm := fi.Mode().Perm(); fi.Mode().IsRegular() && perm&077 != 0 {
+			if err := os.Chmod(filepath.Join(dir, fi.Name()), perm&0700); err != nil {
+				return err
+			}
+		}
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if perm := fi.Mode().Perm(); perm&077 != 0 {
+		if err := os.Chmod(dir, perm&0700); err != nil {
+			return fmt.Errorf(`%s is accessible to other users (%v): %v`, dir, perm, err)
+		}
+		log.Printf(`%s was accessible to other users (%v); it no longer is.`, dir, perm)
+	}
+	return nil
+}
+
+// dataFile is where the file named name lives.
+func dataFile(name string) string {
+	return filepath.Join(dataDir, name)
+}
+
+// writeAtomic replaces path with data so that a crash or power loss leaves
+// either the old contents or the new, never a mix: it writes a temporary
+// file, syncs it, renames it over path and syncs the directory. keep, if
+// above 1, is how many generations to keep: the previous contents move to
+// path.1, those to path.2, and so on.
+func writeAtomic(path string, data []byte, keep int) error {
+	tmp := path + `.tmp`
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// The current generation is linked rather than moved, then replaced in
+	// one rename, so that a crash never leaves path missing.
+	for i := keep - 1; i > 1; i-- {
+		err := os.Rename(generation(path, i-1), generation(path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if keep > 1 {
+		if err := os.Remove(generation(path, 1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Link(path, generation(path, 1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// generation is the name of the i-th previous generation of path.
+func generation(path string, i int) string {
+	if i == 0 {
+		return path
+	}
+	return fmt.Sprintf(`%s.%d`, path, i)
+}
+
+// readGeneration reads the newest generation of path that load accepts,
+// returning which one it was, or -1 if there is none.
+func readGeneration(path string, keep int, load func([]byte) error) (int, error) {
+	var last error
+	for i := 0; i < keep; i++ {
+		b, err := ioutil.ReadFile(generation(path, i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			if err = load(b); err == nil {
+				return i, last
+			}
+		}
+		last = fmt.Errorf(`%s: %v`, generation(path, i), err)
+	}
+	return -1, last
+}
+
+// syncDir makes renames and new files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,16 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package main
+
+import (
+	`log`
+	`os`
+)
+
+// lockPath opens path, creating it if need be. There is no locking it on
+// this system, so running two instances on one data directory is up to the
+// operator to avoid.
+func lockPath(path string) (*os.File, error) {
+	log.Printf(`Unable to lock %s on this system; make sure no other instance uses it.`, path)
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
@@ -0,0 +1,122 @@
+package main
+
+// These need no running service.
+
+import (
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`testing`
+)
+
+func TestWriteAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `kirkwood.dat`)
+	for i := 1; i <= 4; i++ {
+		if err := writeAtomic(path, []byte(fmt.Sprint(i)), 3); err != nil {
+			t.Fatalf(`Write %d failed: %v`, i, err)
+		}
+	}
+
+	// The newest three generations are kept, newest first.
+	for i, want := range []string{`4`, `3`, `2`} {
+		if b, err := ioutil.ReadFile(generation(path, i)); err != nil || string(b) != want {
+			t.Errorf(`Generation %d holds %q, %v; expected %q.`, i, b, err, want)
+		}
+	}
+	if _, err := os.Stat(generation(path, 3)); !os.IsNotExist(err) {
+		t.Errorf(`Generation 3 was kept: %v`, err)
+	}
+	if _, err := os.Stat(path + `.tmp`); !os.IsNotExist(err) {
+		t.Errorf(`Temporary file was left behind: %v`, err)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf(`Snapshot mode is %v, expected 0600.`, fi.Mode().Perm())
+	}
+}
+
+func TestReadGeneration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `kirkwood.dat`)
+	load := func(b []byte) error {
+		if string(b) != `good` {
+			return fmt.Errorf(`bad snapshot`)
+		}
+		return nil
+	}
+
+	// Nothing to read is no error.
+	if gen, err := readGeneration(path, 3, load); gen != -1 || err != nil {
+		t.Errorf(`Reading no snapshot returned %d, %v; expected -1, nil.`, gen, err)
+	}
+
+	// A corrupt newest generation is skipped for the next one that loads.
+	writeAtomic(path, []byte(`good`), 3)
+	writeAtomic(path, []byte(`good`), 3)
+	writeAtomic(path, []byte(`torn`), 3)
+	if gen, err := readGeneration(path, 3, load); gen != 1 || err == nil {
+		t.Errorf(`Reading past a corrupt snapshot returned %d, %v; expected 1 and an error.`, gen, err)
+	}
+
+	// With none that loads, the error says so.
+	writeAtomic(path, []byte(`torn`), 3)
+	writeAtomic(path, []byte(`torn`), 3)
+	if gen, err := readGeneration(path, 3, load); gen != -1 || err == nil {
+		t.Errorf(`Reading only corrupt snapshots returned %d, %v; expected -1 and an error.`, gen, err)
+	}
+}
+
+func TestFindDataDir(t *testing.T) {
+	defer func(dir, config string) { *dataDirFlag, *configFile = dir, config }(*dataDirFlag, *configFile)
+	defer os.Setenv(`KIRKWOOD_DATA_DIR`, os.Getenv(`KIRKWOOD_DATA_DIR`))
+	config := filepath.Join(t.TempDir(), `kirkwood.json`)
+	ioutil.WriteFile(config, []byte(`{"data_dir": "/from/config"}`), 0600)
+
+	// Flags, being explicit, come before the environment.
+	for _, c := range []struct{ flag, config, env, want string }{
+		{`/from/flag`, config, `/from/env`, `/from/flag`},
+		{``, config, `/from/env`, `/from/config`},
+		{``, ``, `/from/env`, `/from/env`},
+	} {
+		*dataDirFlag, *configFile = c.flag, c.config
+		os.Setenv(`KIRKWOOD_DATA_DIR`, c.env)
+		if dir, err := findDataDir(); err != nil || dir != c.want {
+			t.Errorf(`findDataDir returned %q, %v; expected %q.`, dir, err, c.want)
+		}
+	}
+
+	*dataDirFlag, *configFile = ``, filepath.Join(t.TempDir(), `missing.json`)
+	if dir, err := findDataDir(); err == nil {
+		t.Errorf(`findDataDir returned %q with a missing config file.`, dir)
+	}
+}
+
+func TestOpenDataDir(t *testing.T) {
+	defer func(flag, dir string, f *os.File) { *dataDirFlag, dataDir, lockFile = flag, dir, f }(*dataDirFlag, dataDir, lockFile)
+	*dataDirFlag = filepath.Join(t.TempDir(), `data`)
+	os.Mkdir(*dataDirFlag, 0755)
+	snap := filepath.Join(*dataDirFlag, `kirkwood.dat`)
+	ioutil.WriteFile(snap, nil, 0644)
+	os.Chmod(snap, 0644)
+
+	if err := openDataDir(); err != nil {
+		t.Fatalf(`openDataDir failed: %v`, err)
+	}
+	defer lockFile.Close()
+	if fi, err := os.Stat(*dataDirFlag); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0700 {
+		t.Errorf(`Data directory mode is %v, expected 0700.`, fi.Mode().Perm())
+	}
+	if fi, err := os.Stat(snap); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf(`Snapshot mode is %v, expected 0600.`, fi.Mode().Perm())
+	}
+
+	// A second instance is locked out while the first runs.
+	if err := openDataDir(); err == nil {
+		t.Errorf(`Opened a data directory already in use.`)
+	}
+}
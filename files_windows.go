@@ -0,0 +1,21 @@
+package main
+
+import (
+	`os`
+	`syscall`
+)
+
+// lockPath opens path, creating it if need be, allowing no other handle to
+// it for as long as it stays open, which locks it as flock does elsewhere.
+func lockPath(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
@@ -0,0 +1,3 @@
+module github.com/tunezaq/gitwServiceChallenge
+
+go 1.22
@@ -0,0 +1,103 @@
+package main
+
+import (
+	`flag`
+	`fmt`
+	`log`
+	`os`
+	`sync/atomic`
+	`time`
+)
+
+// fsyncPolicy is when logs are synced to disk: after every write
+// (syncAlways), never, leaving it to the OS (syncNever), or every so often.
+type fsyncPolicy time.Duration
+
+const (
+	syncAlways fsyncPolicy = 0
+	syncNever  fsyncPolicy = -1
+)
+
+var fsync = fsyncPolicy(time.Second)
+
+func init() {
+	flag.Var(&fsync, `fsync`, `When to sync logs to disk: always, never, or every so often, such as 1s.`)
+}
+
+func (p fsyncPolicy) String() string {
+	switch p {
+	case syncAlways:
+		return `always`
+	case syncNever:
+		return `never`
+	}
+	return time.Duration(p).String()
+}
+
+func (p *fsyncPolicy) Set(s string) error {
+	switch s {
+	case `always`:
+		*p = syncAlways
+	case `never`:
+		*p = syncNever
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf(`want always, never or a positive duration, got %q`, s)
+		}
+		*p = fsyncPolicy(d)
+	}
+	return nil
+}
+
+// logFile is a segment of a namespace's log of changes since its last
+// snapshot. Every change is written through to the OS at once, so only
+// fsync decides what a power loss, as opposed to a crash, may lose.
+type logFile struct {
+	f       *os.File
+	written int64 // Bytes written so far, atomically.
+	failed  int32 // Set, atomically, once a write or sync fails.
+}
+
+func openLog(path string) (*logFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{f: f}, nil
+}
+
+func (l *logFile) Write(b []byte) (int, error) {
+	n, err := l.f.Write(b)
+	atomic.AddInt64(&l.written, int64(n))
+	if err == nil && fsync == syncAlways {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		atomic.StoreInt32(&l.failed, 1)
+		log.Printf(`[ERROR] Unable to write %s: %v`, l.f.Name(), err)
+	}
+	return n, err
+}
+
+func (l *logFile) size() int64 {
+	return atomic.LoadInt64(&l.written)
+}
+
+// broken reports whether a write or sync failed, leaving the segment short
+// of changes until the next snapshot.
+func (l *logFile) broken() bool {
+	return atomic.LoadInt32(&l.failed) != 0
+}
+
+func (l *logFile) sync() {
+	if err := l.f.Sync(); err != nil {
+		atomic.StoreInt32(&l.failed, 1)
+		log.Printf(`[ERROR] Unable to sync %s: %v`, l.f.Name(), err)
+	}
+}
+
+func (l *logFile) close() {
+	l.sync()
+	l.f.Close()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/ioutil`
+	`net/http`
+
+	`github.com/tunezaq/gitwServiceChallenge/cache`
+)
+
+type (
+	// limits are the size limits of a namespace in bytes: of request
+	// bodies, key text and JSON-encoded values. Zero means unbounded.
+	limits struct {
+		body, key, value int64
+	}
+
+	// sizeError says what was too large, and the limit it broke.
+	sizeError struct {
+		what  string
+		limit int64
+	}
+
+	// limitError is the body of a 413 response.
+	limitError struct {
+		Error string `json:"error"`
+		Limit int64  `json:"limit"`
+	}
+)
+
+func (e *sizeError) Error() string {
+	return fmt.Sprintf(`%s is larger than the limit of %d bytes`, e.what, e.limit)
+}
+
+func writeTooLarge(w http.ResponseWriter, err *sizeError) {
+	body, _ := json.Marshal(limitError{err.Error(), err.limit})
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(413)
+	w.Write(body)
+}
+
+// readBody reads the body of r, giving up with a sizeError as soon as it
+// has read more than limit bytes.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	if limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return nil, &sizeError{`request body`, mbe.Limit}
+	}
+	return body, err
+}
+
+// check checks the sizes of a key and value about to be stored.
+func (l limits) check(k cache.Key, v interface{}) *sizeError {
+	if l.key > 0 && int64(len(k.Text)) > l.key {
+		return &sizeError{`key`, l.key}
+	}
+	if l.value > 0 {
+		if b, err := json.Marshal(v); err == nil && int64(len(b)) > l.value {
+			return &sizeError{`value`, l.value}
+		}
+	}
+	return nil
+}
+
+// limit wraps fn so that the values it makes are checked against the value
+// limit, failing with 413.
+func (l limits) limit(fn cache.Modifier) cache.Modifier {
+	return func(v interface{}, exists bool) (interface{}, int, error) {
+		v, ret, err := fn(v, exists)
+		if ret == 200 || ret == 201 {
+			if err := l.check(cache.Key{}, v); err != nil {
+				return nil, 413, err
+			}
+		}
+		return v, ret, err
+	}
+}
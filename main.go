@@ -5,270 +5,523 @@ package main
 // ./gitwServiceChallenge
 
 import (
-	`bytes`
-	`encoding/gob` // Persistence
+	`bufio`
+	`context`
+	`encoding/base64`
 	`encoding/json`
+	`flag`
 	`fmt`
-	`io/ioutil`
 	`log`
+	`math`
+	`mime`
 	`net/http`
+	`net/url`
 	`os`
 	`os/signal`
 	`strconv`
+	`strings`
 	`sync`
-	`sync/atomic`
 	`syscall`
 	`time`
+
+	`github.com/tunezaq/gitwServiceChallenge/cache`
 )
 
 var (
-	x_cache map[interface{}]interface{}
-	x_count map[interface{}]int
-	lock    *sync.Mutex
-	prefix  string = `/cache/`
-	plen    int    = len(prefix)
-	wg      *sync.WaitGroup
-	stop    chan os.Signal
-	sched   int32
+	prefix string = `/cache/`
+	plen   int    = len(prefix)
+	wg     *sync.WaitGroup
+	stop   chan os.Signal
+	done   chan struct{}
+	server = &http.Server{Addr: `:8088`}
+
+	maxItems    = flag.Int(`max-items`, 0, `Evict least recently used items beyond this many (0: unbounded).`)
+	maxBytes    = flag.Int64(`max-bytes`, 0, `Evict least recently used items beyond this many bytes (0: unbounded).`)
+	maxReads    = flag.Int(`max-reads`, cache.DefaultMaxReads, `Purge items after this many reads unless they set max_reads (0: unlimited).`)
+	maxBody     = flag.Int64(`max-body`, 1<<20, `Reject request bodies larger than this many bytes (0: unbounded).`)
+	maxKey      = flag.Int64(`max-key`, 64<<10, `Reject keys longer than this many bytes (0: unbounded).`)
+	maxValue    = flag.Int64(`max-value`, 0, `Reject values larger than this many bytes of JSON (0: only bounded by -max-body).`)
+	compress    = flag.Int64(`compress`, 0, `Hold values of at least this many bytes of JSON compressed (0: never).`)
+	dataDirFlag = flag.String(`data-dir`, ``, `Keep snapshots and logs here (default data_dir in -config, $KIRKWOOD_DATA_DIR, or ~/.local/state/kirkwood).`)
+	configFile  = flag.String(`config`, ``, `Read settings, such as data_dir, from this JSON file.`)
+	snapshots   = flag.Int(`snapshots`, 3, `Keep this many generations of snapshots to recover from.`)
+	retention   = flag.Duration(`retention`, 0, `Keep deleted items this long, so they can be undeleted (0: delete at once).`)
 )
 
+// How often expired items are swept out of the store.
+const sweepInterval = time.Second
+
+// The longest TTL accepted, well within what a time.Duration can hold.
+const maxTTL = 100 * 365 * 24 * time.Hour
+
+// The largest max_reads accepted, well within what an int can hold.
+const maxReadLimit = 1e9
+
 type (
-	cache    map[string]interface{}
-	cacheElt struct {
-		Key   interface{} `json:"key"`
-		Value interface{} `json:"value"`
-	}
+	cacheElt  = cache.Elt
 	flatCache struct {
 		Elts []cacheElt `json:"cache"`
+		Next string     `json:"next,omitempty"` // Cursor of the next page.
 	}
+	// cursor is where a page of GET /cache/ ended, sent to clients as an
+	// opaque string.
+	cursor struct {
+		Key     cache.Key `json:"k"`
+		Version uint64    `json:"v"`
+	}
+	// cacheArg is the POST/PUT contract: a cacheElt plus optional item
+	// settings.
+	cacheArg struct {
+		Key       cache.Key   `json:"key"`
+		Value     interface{} `json:"value"`
+		TTL       *float64    `json:"ttl"`        // Seconds from now.
+		ExpiresAt *time.Time  `json:"expires_at"` // RFC 3339.
+		MaxReads  readLimit   `json:"max_reads"`
+		Tags      []string    `json:"tags"`
+	}
+	// readLimit is a read count, or "unlimited" in JSON.
+	readLimit int
 )
 
-func scheduleUpdate() {
-	atomic.StoreInt32(&sched, 1)
+func (l *readLimit) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil && s == `unlimited` {
+		*l = cache.Unlimited
+		return nil
+	}
+	var n float64
+	if err := json.Unmarshal(b, &n); err != nil || n < 1 || n > maxReadLimit || n != math.Trunc(n) {
+		return fmt.Errorf(`max_reads must be an integer from 1 to %d or "unlimited", got %s`, int(maxReadLimit), b)
+	}
+	*l = readLimit(n)
+	return nil
 }
 
+// persist syncs logs as -fsync asks and compacts those grown large.
 func persist() {
 	defer wg.Done()
 	tick := time.Tick(500 * time.Millisecond)
-	p := func() {
-		if atomic.CompareAndSwapInt32(&sched, 1, 0) {
-			var buf bytes.Buffer
-			enc := gob.NewEncoder(&buf)
-			lock.Lock()
-			defer lock.Unlock()
-			if err := enc.Encode(x_cache); err != nil {
-				log.Printf(`[ERROR] Unable to persist cache: %v`, err)
-				return
+	var syncTick <-chan time.Time
+	if fsync > 0 {
+		syncTick = time.Tick(time.Duration(fsync))
+	}
+
+	for {
+		select {
+		case <-syncTick:
+			for _, ns := range allNS() {
+				ns.sync()
 			}
-			if err := enc.Encode(x_count); err != nil {
-				log.Printf(`[ERROR] Unable to persist counts: %v`, err)
-				return
+		case <-tick:
+			for _, ns := range allNS() {
+				ns.persist()
 			}
-			if err := ioutil.WriteFile(`/tmp/kirkwood.dat`, buf.Bytes(), 0644); err != nil {
-				log.Printf(`[ERROR] Unable to write persist file: %v`, err)
+		case <-done:
+			for _, ns := range allNS() {
+				ns.close()
 			}
-			log.Printf(`Persisted %d items.`, len(x_cache))
+			log.Printf(`Done.`)
+			return
 		}
 	}
+}
 
+func sweep() {
+	defer wg.Done()
+	tick := time.NewTicker(sweepInterval)
+	defer tick.Stop()
 	for {
 		select {
-		case <-tick:
-			p()
-		case <-stop:
-			p()
-			log.Printf(`Done.`)
+		case <-tick.C:
+			for _, ns := range allNS() {
+				if n := ns.store.Sweep(); n > 0 {
+					log.Printf(`Expired %d items in %s.`, n, ns.Name)
+				}
+				if st := ns.store.Stats(); st.Evictions > ns.evicted {
+					log.Printf(`Evicted %d items in %s, holding %d items in ~%d bytes.`, st.Evictions-ns.evicted, ns.Name, st.Items, st.Bytes)
+					ns.evicted = st.Evictions
+				}
+			}
+		case <-done:
 			return
 		}
 	}
 }
 
-func unpersist() {
-	if b, err := ioutil.ReadFile(`/tmp/kirkwood.dat`); err == nil {
-		buf := bytes.NewBuffer(b)
-		dec := gob.NewDecoder(buf)
-		if err = dec.Decode(&x_cache); err != nil {
-			log.Printf("[ERROR] Unable to unpersist: %v\n", err)
+func flatten(store cache.Store) flatCache {
+	return flatCache{Elts: store.Snapshot()}
+}
+
+// The media type of GET /cache/ streamed one item per line.
+const ndjson = `application/x-ndjson`
+
+// accepts reports whether the Accept header of r lists the media type t.
+func accepts(r *http.Request, t string) bool {
+	for _, a := range strings.Split(r.Header.Get(`Accept`), `,`) {
+		if mt, _, err := mime.ParseMediaType(a); err == nil && mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// export streams every item of store as a line of JSON, never holding more
+// than a buffer's worth of the output.
+func export(w http.ResponseWriter, store cache.Store) {
+	w.Header().Set(`Content-Type`, ndjson)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := store.Export(func(elt cacheElt) error { return enc.Encode(elt) }); err != nil {
+		log.Printf("[ERROR] Exporting: %v\n", err)
+		return
+	}
+	bw.Flush()
+}
+
+// Sort orders accepted by GET /cache/?sort=.
+var orders = map[string]cache.Order{
+	`key`:     cache.ByKey,
+	`version`: cache.ByVersion,
+}
+
+// listOpts reads the query parameters of GET /cache/. Without any, ok is
+// false and the whole store is listed in no particular order, as it always
+// was; with any, the listing is sorted by key unless ?sort= says otherwise.
+func listOpts(r *http.Request) (o cache.ListOptions, ok bool, err error) {
+	q := r.URL.Query()
+	for _, p := range []string{`limit`, `cursor`, `prefix`, `type`, `sort`} {
+		ok = ok || q[p] != nil
+	}
+	if !ok {
+		return
+	}
+
+	o.Order, o.Prefix = cache.ByKey, q.Get(`prefix`)
+	if v := q.Get(`sort`); v != `` {
+		var found bool
+		o.Desc = strings.HasPrefix(v, `-`)
+		if o.Order, found = orders[strings.TrimPrefix(v, `-`)]; !found {
+			return o, ok, fmt.Errorf(`unknown sort order %q`, v)
+		}
+	}
+	if v := q.Get(`type`); v != `` {
+		if o.Kind, err = cache.ParseKind(v); err != nil {
+			return
+		}
+	}
+	if v := q.Get(`limit`); v != `` {
+		if o.Limit, err = strconv.Atoi(v); err == nil && o.Limit < 1 {
+			err = fmt.Errorf(`limit must be positive, got %d`, o.Limit)
+		}
+		if err != nil {
 			return
 		}
-		if err = dec.Decode(&x_count); err != nil {
-			log.Printf("[ERROR] Unable to unpersist: %v\n", err)
+	}
+	if v := q.Get(`cursor`); v != `` {
+		var c cursor
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err == nil {
+			err = json.Unmarshal(b, &c)
+		}
+		if err != nil {
+			return o, ok, fmt.Errorf(`invalid cursor %q`, v)
 		}
+		o.After = &cacheElt{Key: c.Key, Version: c.Version}
 	}
+	return
 }
 
-func update(k interface{}, v interface{}) int {
-	lock.Lock()
-	defer lock.Unlock()
-	if _, found := x_cache[k]; found {
-		x_cache[k] = v
-		scheduleUpdate()
-		return 204
+// list lists the page of items o selects, with the cursor of the next page
+// if there are more.
+func list(store cache.Store, o cache.ListOptions) flatCache {
+	elts, more := store.List(o)
+	fc := flatCache{Elts: elts}
+	if more {
+		last := elts[len(elts)-1]
+		b, _ := json.Marshal(cursor{last.Key, last.Version})
+		fc.Next = base64.RawURLEncoding.EncodeToString(b)
 	}
-	return 404
+	return fc
 }
 
-func create(k interface{}, v interface{}) int {
-	lock.Lock()
-	defer lock.Unlock()
-	if _, found := x_cache[k]; !found {
-		x_cache[k] = v
-		x_count[k] = 0
-		scheduleUpdate()
-		return 201
+func parseArg(b []byte) (arg cacheArg, err error) {
+	if err = json.Unmarshal(b, &arg); err == nil {
+		err = arg.check()
 	}
-	return 409
+	return
 }
 
-func get(k string) ([]cacheElt, int) {
-	lock.Lock()
-	defer lock.Unlock()
-	// get only works on strings (from the URL), so we have to try to
-	// coerce other types from the key.
-	elts := make([]cacheElt, 0)
-	if v, ok := x_cache[k]; ok {
-		elts = append(elts, cacheElt{k, v})
-		if x_count[k] == 99 {
-			delete(x_cache, k)
-			delete(x_count, k)
-		} else {
-			x_count[k]++
-		}
+func (arg cacheArg) check() (err error) {
+	if arg.Key.IsZero() {
+		err = fmt.Errorf(`missing key`)
+	} else if arg.TTL != nil && arg.ExpiresAt != nil {
+		err = fmt.Errorf(`ttl and expires_at are mutually exclusive`)
+	} else if arg.TTL != nil && (*arg.TTL <= 0 || *arg.TTL > maxTTL.Seconds()) {
+		err = fmt.Errorf(`ttl must be positive and at most %v seconds, got %v`, maxTTL.Seconds(), *arg.TTL)
+	} else if arg.ExpiresAt != nil && !arg.ExpiresAt.After(time.Now()) {
+		err = fmt.Errorf(`expires_at is in the past: %v`, arg.ExpiresAt.Format(time.RFC3339))
+	} else if contains(arg.Tags, ``) {
+		err = fmt.Errorf(`tags must not be empty`)
 	}
-	if i, err := strconv.ParseInt(k, 10, 64); err == nil {
-		if v, ok := x_cache[int(i)]; ok {
-			elts = append(elts, cacheElt{i, v})
-			if x_count[i] == 99 {
-				delete(x_cache, i)
-				delete(x_count, i)
-			} else {
-				x_count[i]++
-			}
-		}
+	return
+}
+
+// wantsUpsert reports whether r opts into upsert semantics, with ?upsert
+// or Prefer: upsert: PUT creates missing items, and POST returns existing
+// ones rather than failing.
+func wantsUpsert(r *http.Request) (bool, error) {
+	if up, err := flagParam(r, `upsert`); up || err != nil {
+		return up, err
 	}
-	if f, err := strconv.ParseFloat(k, 64); err == nil {
-		if v, ok := x_cache[f]; ok {
-			elts = append(elts, cacheElt{f, v})
-			if x_count[f] == 99 {
-				delete(x_cache, f)
-				delete(x_count, f)
-			} else {
-				x_count[f]++
+	for _, h := range r.Header[`Prefer`] {
+		for _, p := range strings.Split(h, `,`) {
+			if strings.TrimSpace(strings.SplitN(p, `;`, 2)[0]) == `upsert` {
+				return true, nil
 			}
 		}
 	}
-	if b, err := strconv.ParseBool(k); err == nil {
-		if v, ok := x_cache[b]; ok {
-			elts = append(elts, cacheElt{b, v})
-			if x_count[b] == 99 {
-				delete(x_cache, b)
-				delete(x_count, b)
-			} else {
-				x_count[b]++
+	return false, nil
+}
+
+// flagParam reads a boolean query parameter, which is true if given
+// without a value.
+func flagParam(r *http.Request, name string) (bool, error) {
+	q := r.URL.Query()
+	if _, ok := q[name]; !ok {
+		return false, nil
+	}
+	if v := q.Get(name); v != `` {
+		return strconv.ParseBool(v)
+	}
+	return true, nil
+}
+
+func (arg cacheArg) meta() (m cache.Meta) {
+	if arg.TTL != nil {
+		m.Expires = time.Now().Add(time.Duration(*arg.TTL * float64(time.Second)))
+	} else if arg.ExpiresAt != nil {
+		m.Expires = *arg.ExpiresAt
+	}
+	m.MaxReads = int(arg.MaxReads)
+	if arg.Tags != nil {
+		m.Tags = make([]string, 0, len(arg.Tags))
+		for _, t := range arg.Tags {
+			if !contains(m.Tags, t) {
+				m.Tags = append(m.Tags, t)
 			}
 		}
 	}
+	return
+}
 
-	if len(elts) > 0 {
-		scheduleUpdate()
-		return elts, 200
+// keysFor lists the keys a URL key segment refers to. With ?type= that is
+// exactly one key of that type; without, it is every key the text could be
+// (see cache.Candidates), so /cache/123 matches both "123" and 123.
+func keysFor(r *http.Request, text string) ([]cache.Key, error) {
+	t := r.URL.Query().Get(`type`)
+	if t == `` {
+		return cache.Candidates(text), nil
+	}
+	kind, err := cache.ParseKind(t)
+	if err != nil {
+		return nil, err
 	}
+	if k, err := cache.ParseKey(text, kind); err == nil {
+		return []cache.Key{k}, nil
+	}
+	return nil, nil // No key of that type looks like this.
+}
 
-	return nil, 404
+// etag formats a version as an entity tag.
+func etag(version uint64) string {
+	return fmt.Sprintf(`"%d"`, version)
 }
 
-func rm(k string) int {
-	lock.Lock()
-	defer lock.Unlock()
-	// get only works on strings (from the URL), so we have to try to
-	// coerce other types from the key.
-	ret := 404
-	if k == "" {
-		x_cache = make(map[interface{}]interface{})
-		x_count = make(map[interface{}]int)
-		ret = 204
-	}
-	if _, found := x_cache[k]; found {
-		delete(x_cache, k)
-		delete(x_count, k)
-		ret = 204
-	}
-	if i, err := strconv.ParseInt(k, 10, 64); err == nil {
-		if _, found := x_cache[i]; found {
-			delete(x_cache, i)
-			delete(x_count, i)
-			ret = 204
-		}
+// parseETags parses an If-Match or If-None-Match header into versions.
+// Tags we can't have issued are dropped, as are weak ones unless weak
+// comparison applies. The result is nil only if the header is absent.
+func parseETags(h string, weak bool) []uint64 {
+	if h == `` {
+		return nil
 	}
-	if f, err := strconv.ParseFloat(k, 64); err == nil {
-		if _, found := x_cache[f]; found {
-			delete(x_cache, f)
-			delete(x_count, f)
-			ret = 204
+	vs := make([]uint64, 0)
+	for _, tag := range strings.Split(h, `,`) {
+		tag = strings.TrimSpace(tag)
+		if tag == `*` {
+			vs = append(vs, cache.Any)
+			continue
 		}
-	}
-	if b, err := strconv.ParseBool(k); err == nil {
-		if _, found := x_cache[b]; found {
-			delete(x_cache, b)
-			delete(x_count, b)
-			ret = 204
+		if strings.HasPrefix(tag, `W/`) {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if v, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 64); err == nil && v != cache.Any {
+			vs = append(vs, v)
 		}
 	}
+	return vs
+}
 
-	if ret == 204 {
-		scheduleUpdate()
+// cond reads the preconditions of a request. If-Match compares strongly and
+// If-None-Match weakly, as in RFC 7232.
+func cond(r *http.Request) cache.Cond {
+	return cache.Cond{
+		IfMatch:     parseETags(r.Header.Get(`If-Match`), false),
+		IfNoneMatch: parseETags(r.Header.Get(`If-None-Match`), true),
 	}
+}
 
-	return ret
+func containsKey(ks []cache.Key, k cache.Key) bool {
+	for _, c := range ks {
+		if c == k {
+			return true
+		}
+	}
+	return false
 }
 
-func flatten() flatCache {
-	lock.Lock()
-	defer lock.Unlock()
-	elts := make([]cacheElt, len(x_cache))
-	f := flatCache{elts}
-	i := 0
-	for k, v := range x_cache {
-		f.Elts[i].Key, f.Elts[i].Value = k, v
-		i++
-	}
-	return f
+func contains(ss []string, s string) bool {
+	for _, c := range ss {
+		if c == s {
+			return true
+		}
+	}
+	return false
 }
 
-func parseArg(b []byte) (elt cacheElt, err error) {
-	err = json.Unmarshal(b, &elt)
-	return
+// get reads every key in ks that exists: 200, or 404 if none does.
+func get(store cache.Store, ks []cache.Key) ([]cacheElt, int) {
+	elts := make([]cacheElt, 0)
+	for _, k := range ks {
+		if elt, ret := store.Get(k); ret == 200 {
+			elts = append(elts, elt)
+		}
+	}
+	if len(elts) > 0 {
+		return elts, 200
+	}
+	return nil, 404
+}
+
+// rm deletes every key in ks that exists and satisfies c: 204 if any did,
+// else 412 if c failed, else 404.
+func rm(store cache.Store, ks []cache.Key, c cache.Cond) int {
+	ret := 404
+	for _, k := range ks {
+		if r := store.Delete(k, c); r == 204 || r == 412 && ret == 404 {
+			ret = r
+		}
+	}
+	return ret
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	body, bodyerr := ioutil.ReadAll(r.Body)
+	serveCache(w, r, lookupNS(defaultNS), r.URL.EscapedPath()[plen:])
+}
+
+// serveCache serves path, the escaped path below /cache/, from the
+// namespace ns.
+func serveCache(w http.ResponseWriter, r *http.Request, ns *namespace, path string) {
+	body, bodyerr := readBody(w, r, ns.lim.body)
+	if err, ok := bodyerr.(*sizeError); ok {
+		writeTooLarge(w, err)
+		return
+	}
 
 	var (
 		ret   int
 		s     interface{}
-		key   = r.URL.Path[plen:]
+		store = ns.store
 		v     []cacheElt
 		abort = false
 	)
 
+	// Keys may contain slashes, so only a last segment naming an action
+	// is taken as one.
+	action := ``
+	if i := strings.LastIndex(path, `/`); i >= 0 && actions[path[i+1:]] {
+		path, action = path[:i], path[i+1:]
+	}
+	key, err := url.PathUnescape(path)
+	keys, kerr := keysFor(r, key)
+	if err != nil || kerr != nil {
+		log.Printf("[ERROR] Bad key %q: %v %v\n", path, err, kerr)
+		w.WriteHeader(406)
+		return
+	}
+	if key == batchKey && r.Method == `POST` {
+		serveBatch(w, r, ns, body)
+		return
+	}
+	if key == txnKey && r.Method == `POST` {
+		serveTxn(w, r, ns, body)
+		return
+	}
+	if action != `` {
+		serveAction(w, r, ns, keys, action, body)
+		return
+	}
+
+	if r.Method == `PATCH` && key != `` {
+		servePatch(w, r, ns, keys, body)
+		return
+	}
+
+	up, err := wantsUpsert(r)
+	if r.Method == `POST` || r.Method == `PUT` {
+		if err != nil {
+			log.Printf("[ERROR] Bad upsert: %v\n", err)
+			w.WriteHeader(406)
+			return
+		}
+		if up {
+			w.Header().Set(`Preference-Applied`, `upsert`)
+		}
+	}
+
 	switch r.Method {
 	case `DELETE`:
 		fmt.Printf("TIME TO DELETE\n\n\n")
-		ret = rm(key)
+		if key == `` {
+			store.Clear()
+			ret = 204
+		} else {
+			ret = rm(store, keys, cond(r))
+		}
 	case `GET`:
 		if key == `` {
-			s = flatten()
-			ret = 200
+			o, ok, err := listOpts(r)
+			stream := accepts(r, ndjson)
+			if err == nil && ok && stream {
+				err = fmt.Errorf(`exports can't be paged or filtered`)
+			}
+			if err != nil {
+				log.Printf("[ERROR] Bad listing: %v\n", err)
+				ret = 406
+				abort = true
+			} else if stream {
+				export(w, store)
+				return
+			} else if ok {
+				s, ret = list(store, o), 200
+			} else {
+				s, ret = flatten(store), 200
+			}
 		} else {
-			v, ret = get(key)
+			v, ret = get(store, keys)
+			if len(v) == 1 {
+				w.Header().Set(`ETag`, etag(v[0].Version))
+			}
 			if abort = ret == 404; !abort {
 				if len(v) == 0 {
 					s = nil
 				} else if len(v) == 1 {
 					s = v
 				} else {
-					s = flatCache{v}
+					s = flatCache{Elts: v}
 				}
 			}
 		}
@@ -277,27 +530,79 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			log.Printf("[ERROR] Reading payload: %v\n", bodyerr)
 			ret = 406
 			abort = true
-		} else if elt, err := parseArg(body); err == nil {
-			ret = create(elt.Key, elt.Value)
+		} else if arg, err := parseArg(body); err == nil {
+			if err := ns.lim.check(arg.Key, arg.Value); err != nil {
+				writeTooLarge(w, err)
+				return
+			}
+			var version uint64
+			version, ret = store.Create(arg.Key, arg.Value, arg.meta())
+			// With upsert, answer with the item that is there as GET would.
+			// Should it go before we get it, try creating it again.
+			for tries := 1; ret == 409 && up && tries < 3; tries++ {
+				if elt, found := store.Get(arg.Key); found == 200 {
+					s, ret = []cacheElt{elt}, 200
+					w.Header().Set(`ETag`, etag(elt.Version))
+					w.Header().Set(`Location`, ns.prefix()+arg.Key.URLPath())
+				} else {
+					version, ret = store.Create(arg.Key, arg.Value, arg.meta())
+				}
+			}
 			abort = ret == 404
 			if ret == 201 {
-				s = fmt.Sprintf(`/cache/%s`, key)
+				s = ns.prefix() + arg.Key.URLPath()
+				w.Header().Set(`ETag`, etag(version))
 			}
+		} else {
+			log.Printf("[ERROR] Parsing payload: %v\n", err)
+			ret = 406
+			abort = true
 		}
 	case `PUT`:
 		if bodyerr != nil {
 			fmt.Printf("[ERROR] Reading payload: %v\n", bodyerr)
 			ret = 406
 			abort = true
-		} else if elt, err := parseArg(body); err == nil {
-			if fmt.Sprintf(`%v`, elt.Key) != key {
-				ret = 406 // Key mismatch (?)
-				abort = true
+		} else if arg, err := parseArg(body); err == nil {
+			if err := ns.lim.check(arg.Key, arg.Value); err != nil {
+				writeTooLarge(w, err)
+				return
+			}
+			var version uint64
+			if containsKey(keys, arg.Key) && up {
+				version, ret = store.Upsert(arg.Key, arg.Value, arg.meta(), cond(r))
+			} else if containsKey(keys, arg.Key) {
+				version, ret = store.Update(arg.Key, arg.Value, arg.meta(), cond(r))
+			} else if from, found := one(store, keys); found != 200 {
+				ret = found
 			} else {
-				ret = update(elt.Key, elt.Value)
-				abort = ret == 404
+				// A different key in the body moves the item there.
+				version, ret = store.Rename(from, arg.Key, arg.Value, arg.meta(), cond(r))
+				if ret == 204 {
+					w.Header().Set(`Location`, ns.prefix()+arg.Key.URLPath())
+				}
+			}
+			if ret == 201 {
+				s = ns.prefix() + arg.Key.URLPath()
 			}
+			if ret == 201 || ret == 204 {
+				w.Header().Set(`ETag`, etag(version))
+			}
+			abort = ret != 201 && ret != 204
+		} else {
+			log.Printf("[ERROR] Parsing payload: %v\n", err)
+			ret = 406
+			abort = true
+		}
+	default:
+		// PATCH only applies to a single item.
+		if key == `` {
+			w.Header().Set(`Allow`, `DELETE, GET, POST`)
+		} else {
+			w.Header().Set(`Allow`, `DELETE, GET, PATCH, POST, PUT`)
 		}
+		ret = 405
+		abort = true
 	}
 
 	body = nil
@@ -310,43 +615,76 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(ret)
 	if body != nil {
-		fmt.Fprintf(w, string(body))
+		w.Write(body)
+	}
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != `GET` {
+		w.WriteHeader(405)
+		return
 	}
+	body, _ := json.Marshal(lookupNS(defaultNS).store.Stats())
+	w.Write(body)
 }
 
 func serve() {
 	http.HandleFunc(`/cache/`, handler)
-	http.ListenAndServe(`:8088`, nil)
+	http.HandleFunc(nsPrefix, nsHandler)
+	http.HandleFunc(tagPrefix, tagsHandler)
+	http.HandleFunc(tombPrefix, tombstonesHandler)
+	http.HandleFunc(`/stats`, statsHandler)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalf(`Unable to serve: %v`, err)
+	}
 }
 
 func main() {
-	lock = &sync.Mutex{}
-	x_cache = make(map[interface{}]interface{})
-	x_count = make(map[interface{}]int)
+	flag.Parse()
+	if *maxReads <= 0 {
+		*maxReads = cache.Unlimited
+	}
+	if *snapshots < 1 {
+		*snapshots = 1
+	}
 	stop = make(chan os.Signal, 1)
 
-	unpersist()
+	if err := openDataDir(); err != nil {
+		log.Fatalf(`Unable to open the data directory: %v`, err)
+	}
+	loadNamespaces()
+	store := lookupNS(defaultNS).store
 
 	wg = new(sync.WaitGroup)
-	wg.Add(1)
+	done = make(chan struct{})
+	wg.Add(2)
 	go persist()
+	go sweep()
 
-	create(`foo`, `bar`)
-	create(`baz`, 100000000.000000001)
-	create(`quux`, `Hello, world!`)
-	create(123, `Integer`)
-	create(123.0, `Float`)
-	create(false, `Boolean`)
-	r, v := get(`123`)
+	store.Create(cache.StringKey(`foo`), `bar`, cache.Meta{})
+	store.Create(cache.StringKey(`baz`), 100000000.000000001, cache.Meta{})
+	store.Create(cache.StringKey(`quux`), `Hello, world!`, cache.Meta{})
+	store.Create(cache.NumberKey(123), `Integer`, cache.Meta{})
+	store.Create(cache.NumberKey(123.0), `Float`, cache.Meta{}) // Same key.
+	store.Create(cache.BoolKey(false), `Boolean`, cache.Meta{})
+	r, v := get(store, cache.Candidates(`123`))
 	fmt.Println(`123 =>`, r, v)
-	r, v = get(`123.0`)
+	r, v = get(store, cache.Candidates(`123.0`))
 	fmt.Println(`123.0 =>`, r, v)
-	r, v = get(`asdlfkj`)
+	r, v = get(store, cache.Candidates(`asdlfkj`))
 	fmt.Println(`asdlfkj =>`, r, v)
 
 	go serve()
 
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	<-stop
+	// Let requests in flight finish, and take no more, before the
+	// namespaces are compacted and closed.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf(`[ERROR] Unable to shut down cleanly: %v`, err)
+	}
+	cancel()
+	close(done)
 	wg.Wait()
 }
@@ -99,6 +99,65 @@ func TestChallenge1Put(t *testing.T) {
 	getKey(t, cp1)
 }
 
+func TestChallenge1PutRename(t *testing.T) {
+	deleteAll(t)
+	cp1 := &CachePair{Key: "before", Value: 1}
+	post(t, cp1)
+
+	// PUT to the old key with a new key and value moves the item.
+	cpJson, _ := json.Marshal(&CachePair{Key: "after", Value: 2})
+	req, _ := http.NewRequest("PUT", LocalHost+"before", bytes.NewReader(cpJson))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Put call failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Response code of %d doesn't match expected %d.", resp.StatusCode, http.StatusNoContent)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/cache/after" {
+		t.Errorf("Location is %q, expected /cache/after.", loc)
+	}
+	getKeyForStatus(t, cp1, http.StatusNotFound)
+	getKey(t, &CachePair{Key: "after", Value: 2})
+
+	// Moving onto an existing item fails.
+	post(t, cp1)
+	req, _ = http.NewRequest("PUT", LocalHost+"before", bytes.NewReader(cpJson))
+	if resp, err = http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("Rename onto an existing key returned %v, %v; expected %d.", err, resp, http.StatusConflict)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	deleteAll(t)
+
+	// PUT creates the missing item.
+	cpJson, _ := json.Marshal(&CachePair{Key: "upserted", Value: 1})
+	req, _ := http.NewRequest("PUT", LocalHost+"upserted?upsert", bytes.NewReader(cpJson))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Put call failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/cache/upserted" {
+		t.Errorf("Upsert returned %d with Location %q; expected %d.", resp.StatusCode, resp.Header.Get("Location"), http.StatusCreated)
+	}
+
+	// POST returns it rather than failing.
+	cpJson, _ = json.Marshal(&CachePair{Key: "upserted", Value: 2})
+	req, _ = http.NewRequest("POST", LocalHost, bytes.NewReader(cpJson))
+	req.Header.Set("Prefer", "upsert")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("Post call failed: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	// It comes back as GET would return it: in an array.
+	var data []CachePair
+	if err := json.Unmarshal(body, &data); err != nil || resp.StatusCode != http.StatusOK || len(data) != 1 || data[0].Value != 1.0 {
+		t.Errorf("Post of an existing key returned %d %s; expected %d with the existing item.", resp.StatusCode, body, http.StatusOK)
+	}
+}
+
 func TestChallenge1DeleteKey(t *testing.T) {
 	// Start from a clean slate.
 	deleteAll(t)
@@ -127,6 +186,46 @@ func TestChallenge1PostUnhappy(t *testing.T) {
 	postForStatus(t, cp1, http.StatusConflict)
 }
 
+func TestLifetimeUnhappy(t *testing.T) {
+	deleteAll(t)
+
+	// Lifetimes that would make the item expire at once are refused, as
+	// are read limits too large to hold.
+	for _, body := range []string{
+		`{"key":"brief","value":1,"ttl":1e10}`,
+		`{"key":"brief","value":1,"expires_at":"2000-01-01T00:00:00Z"}`,
+		`{"key":"brief","value":1,"max_reads":1e300}`,
+	} {
+		resp, err := http.Post(LocalHost, "application/json", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("Post call failed: %s", err)
+		}
+		if resp.StatusCode != http.StatusNotAcceptable {
+			t.Errorf("Posting %s returned %d; expected %d.", body, resp.StatusCode, http.StatusNotAcceptable)
+		}
+	}
+}
+
+func TestSlashedKeys(t *testing.T) {
+	deleteAll(t)
+
+	// Keys may contain slashes; only a known action ends a URL.
+	cp1 := &CachePair{Key: "a/b", Value: "slashed"}
+	post(t, cp1)
+	for _, path := range []string{"a/b", "a%2Fb", "a/b/_meta"} {
+		resp, err := http.Get(LocalHost + path)
+		if err != nil {
+			t.Fatalf("Initial connection failed: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET of %s returned %d; expected %d.", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+	getKeyForStatus(t, &CachePair{Key: "a/b/c"}, http.StatusNotFound)
+	getAll(t, []*CachePair{cp1})
+}
+
 func TestChallenge1GetUnhappy(t *testing.T) {
 	// Start from a clean slate.
 	deleteAll(t)
@@ -154,6 +253,27 @@ func TestChallenge1DeleteUnhappy(t *testing.T) {
 	deleteKeyForStatus(t, cp_unknown, http.StatusNotFound)
 }
 
+func TestMethodNotAllowed(t *testing.T) {
+	deleteAll(t)
+
+	// PATCH needs a key; the cache as a whole can't be patched.
+	for _, c := range []struct{ method, path, allow string }{
+		{"PATCH", "", "DELETE, GET, POST"},
+		{"OPTIONS", "", "DELETE, GET, POST"},
+		{"OPTIONS", "some-key", "DELETE, GET, PATCH, POST, PUT"},
+	} {
+		req, _ := http.NewRequest(c.method, LocalHost+c.path, bytes.NewReader([]byte(`{"value":1}`)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s call failed: %s", c.method, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != c.allow {
+			t.Errorf("%s of %q returned %d with Allow %q; expected %d with %q.", c.method, c.path, resp.StatusCode, resp.Header.Get("Allow"), http.StatusMethodNotAllowed, c.allow)
+		}
+	}
+}
+
 func TestChallenge1CrazyLength(t *testing.T) {
 	deleteAll(t)
 
@@ -224,6 +344,150 @@ func TestChallenge1CrazySize(t *testing.T) {
 	getAll(t, biggun_cache[0:biggun_size])
 }
 
+func TestNamespaces(t *testing.T) {
+	deleteAll(t)
+	nsHost := "http://localhost:8088/ns/"
+
+	// Create a namespace, dropping any leftover from an earlier run first.
+	req, _ := http.NewRequest("DELETE", nsHost+"testing", nil)
+	http.DefaultClient.Do(req)
+	resp, err := http.Post(nsHost, "application/json", bytes.NewReader([]byte(`{"name":"testing"}`)))
+	if err != nil {
+		t.Fatalf("Initial connection failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Response code of %d doesn't match expected %d.", resp.StatusCode, http.StatusCreated)
+	}
+
+	// The same key can live in both namespaces.
+	cp1 := &CachePair{Key: "shared", Value: "default"}
+	post(t, cp1)
+	cpJson, _ := json.Marshal(&CachePair{Key: "shared", Value: "testing"})
+	resp, err = http.Post(nsHost+"testing/cache/", "application/json", bytes.NewReader(cpJson))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("Unable to post into the testing namespace: %v, %v.", err, resp)
+	}
+
+	// Wiping the namespace leaves the default one alone.
+	req, _ = http.NewRequest("DELETE", nsHost+"testing/cache/", nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Unable to delete the testing namespace's cache: %v, %v.", err, resp)
+	}
+	getAll(t, []*CachePair{cp1})
+
+	req, _ = http.NewRequest("DELETE", nsHost+"testing", nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Unable to drop the testing namespace: %v, %v.", err, resp)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	nsHost := "http://localhost:8088/ns/"
+	req, _ := http.NewRequest("DELETE", nsHost+"limited", nil)
+	http.DefaultClient.Do(req)
+	resp, err := http.Post(nsHost, "application/json", bytes.NewReader([]byte(`{"name":"limited","max_key":4,"max_value":8}`)))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Unable to create the limited namespace: %v, %v.", err, resp)
+	}
+	defer func() {
+		req, _ := http.NewRequest("DELETE", nsHost+"limited", nil)
+		http.DefaultClient.Do(req)
+	}()
+
+	for _, c := range []struct {
+		cp     CachePair
+		status int
+		limit  int64
+	}{
+		{CachePair{Key: "abcd", Value: "short"}, http.StatusCreated, 0},
+		{CachePair{Key: "abcde", Value: 1}, http.StatusRequestEntityTooLarge, 4},
+		{CachePair{Key: "a", Value: "far too long"}, http.StatusRequestEntityTooLarge, 8},
+	} {
+		cpJson, _ := json.Marshal(&c.cp)
+		resp, err := http.Post(nsHost+"limited/cache/", "application/json", bytes.NewReader(cpJson))
+		if err != nil {
+			t.Fatalf("Post call failed: %s", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var data struct{ Limit int64 }
+		if json.Unmarshal(body, &data); resp.StatusCode != c.status || data.Limit != c.limit {
+			t.Errorf("Posting %v returned %d %s; expected %d with limit %d.", c.cp, resp.StatusCode, body, c.status, c.limit)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	deleteAll(t)
+	cp1 := &CachePair{Key: "batched", Value: "first"}
+	post(t, cp1)
+
+	// An atomic batch that fails changes nothing.
+	batch := `[{"op":"update","key":"batched","value":"second"},{"op":"create","key":"batched","value":"third"}]`
+	resp, err := http.Post("http://localhost:8088/cache/_batch?atomic", "application/json", bytes.NewReader([]byte(batch)))
+	if err != nil {
+		t.Fatalf("Initial connection failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Response code of %d doesn't match expected %d.", resp.StatusCode, http.StatusConflict)
+	}
+	getAll(t, []*CachePair{cp1})
+
+	// Without atomic, every operation goes its own way.
+	resp, err = http.Post("http://localhost:8088/cache/_batch", "application/json", bytes.NewReader([]byte(batch)))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unable to run batch: %v, %v.", err, resp)
+	}
+	var results struct {
+		Results []struct {
+			Status int `json:"status"`
+		} `json:"results"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if json.Unmarshal(body, &results); len(results.Results) != 2 ||
+		results.Results[0].Status != http.StatusNoContent || results.Results[1].Status != http.StatusConflict {
+		t.Errorf("Unexpected batch results %s.", body)
+	}
+	cp1.Value = "second"
+	getAll(t, []*CachePair{cp1})
+}
+
+func TestListing(t *testing.T) {
+	deleteAll(t)
+	for i := 0; i < 5; i++ {
+		post(t, &CachePair{Key: fmt.Sprintf("page%d", i), Value: i})
+	}
+
+	// Paging through returns every item once, sorted by key.
+	var keys []interface{}
+	next := ""
+	for pages := 0; pages < 5; pages++ {
+		resp, err := http.Get(LocalHost + "?limit=2&cursor=" + next)
+		if err != nil {
+			t.Fatalf("Initial connection failed: %s", err)
+		}
+		var page struct {
+			Cache []CachePair `json:"cache"`
+			Next  string      `json:"next"`
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err = json.Unmarshal(body, &page); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unable to list page %d: %d %s", pages, resp.StatusCode, body)
+		}
+		for _, cp := range page.Cache {
+			keys = append(keys, cp.Key)
+		}
+		if next = page.Next; next == "" {
+			break
+		}
+	}
+	if fmt.Sprint(keys) != "[page0 page1 page2 page3 page4]" {
+		t.Errorf("Paged through %v.", keys)
+	}
+}
+
 func TestChallenge2Synchronous(t *testing.T) {
 	deleteAll(t)
 
@@ -397,7 +661,7 @@ func TestChallenge4(t *testing.T) {
     fmt.Printf("Violations is %d, total reqs us %d", sla_violations, total_reqs)
     actual_sla_perc := float64(sla_violations) / float64(total_reqs)
     fmt.Printf("\nYou met the SLA for %.2f percent of requests.\n", (1 - actual_sla_perc) * 100)
-    if (actual_sla_perc >= desired_sla_perc) {
+	if actual_sla_perc >= desired_sla_perc {
         t.Errorf("Test failed! You violated the SLA %.2f of the time, where we required %.2f.", actual_sla_perc, desired_sla_perc)
     }
 }
@@ -0,0 +1,487 @@
+package main
+
+import (
+	`bytes`
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`log`
+	`net/http`
+	`os`
+	`path/filepath`
+	`regexp`
+	`sort`
+	`strconv`
+	`strings`
+	`sync`
+
+	`github.com/tunezaq/gitwServiceChallenge/cache`
+)
+
+// The namespace served under /cache/. It always exists.
+const defaultNS = `default`
+
+var (
+	nsLock     sync.RWMutex
+	namespaces map[string]*namespace
+	// Names being created or dropped, held by nsLock until their files are
+	// in place or gone, which is done without it.
+	nsBusy = map[string]bool{}
+	// Serializes manifest writes.
+	manifestLock sync.Mutex
+	nsPrefix     string = `/ns/`
+	nsName              = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+type (
+	// namespace is an independent cache with its own keyspace, settings
+	// and snapshot file. The exported fields are its settings, as accepted
+	// by POST /ns/ and recorded in the manifest; zero means the service
+	// default.
+	namespace struct {
+		Name     string    `json:"name"`
+		MaxItems int       `json:"max_items,omitempty"`
+		MaxBytes int64     `json:"max_bytes,omitempty"`
+		MaxReads readLimit `json:"max_reads,omitempty"`
+		MaxBody  int64     `json:"max_body,omitempty"`
+		MaxKey   int64     `json:"max_key,omitempty"`
+		MaxValue int64     `json:"max_value,omitempty"`
+
+		store   cache.Store
+		disk    cache.Persister // The same store, as kept on disk.
+		lim     limits
+		evicted uint64 // Evictions last logged by sweep.
+
+		// Serializes snapshot writes and log rotation against each other
+		// and dropping the namespace.
+		mu       sync.Mutex
+		dropped  bool
+		log      *logFile
+		seg      int   // Number of the log segment being written.
+		snapSize int64 // Size of the last snapshot.
+	}
+
+	nsInfo struct {
+		*namespace
+		Stats cache.Stats `json:"stats"`
+	}
+)
+
+func (l readLimit) MarshalJSON() ([]byte, error) {
+	if l == cache.Unlimited {
+		return []byte(`"unlimited"`), nil
+	}
+	return json.Marshal(int(l))
+}
+
+func newNamespace(ns *namespace) *namespace {
+	o := cache.Options{
+		MaxItems:  ns.MaxItems,
+		MaxBytes:  ns.MaxBytes,
+		MaxReads:  int(ns.MaxReads),
+		Retention: *retention,
+		Compress:  *compress,
+	}
+	if o.MaxItems == 0 {
+		o.MaxItems = *maxItems
+	}
+	if o.MaxBytes == 0 {
+		o.MaxBytes = *maxBytes
+	}
+	if o.MaxReads == 0 {
+		o.MaxReads = *maxReads
+	}
+	s := cache.New(o)
+	ns.store, ns.disk = s, s
+	ns.lim = limits{ns.MaxBody, ns.MaxKey, ns.MaxValue}
+	if ns.lim.body == 0 {
+		ns.lim.body = *maxBody
+	}
+	if ns.lim.key == 0 {
+		ns.lim.key = *maxKey
+	}
+	if ns.lim.value == 0 {
+		ns.lim.value = *maxValue
+	}
+	return ns
+}
+
+// Logs are compacted into a snapshot once they are larger than the last
+// snapshot and this.
+const compactMin = 1 << 20
+
+// file is where the namespace's snapshot (ext .dat) or log segments live.
+func (ns *namespace) file(ext string) string {
+	if ns.Name == defaultNS {
+		return dataFile(`kirkwood` + ext)
+	}
+	return dataFile(fmt.Sprintf(`kirkwood.%s%s`, ns.Name, ext))
+}
+
+// prefix is the path the namespace's items are served under.
+func (ns *namespace) prefix() string {
+	if ns.Name == defaultNS {
+		return prefix
+	}
+	return fmt.Sprintf(`%s%s%s`, nsPrefix, ns.Name, prefix)
+}
+
+// snapshot writes the whole namespace to its .dat file. ns.mu must be held.
+func (ns *namespace) snapshot() error {
+	var buf bytes.Buffer
+	n, err := ns.disk.Save(&buf)
+	if err != nil {
+		return err
+	}
+	if err := writeAtomic(ns.file(`.dat`), buf.Bytes(), *snapshots); err != nil {
+		return err
+	}
+	ns.snapSize = int64(buf.Len())
+	log.Printf(`Persisted %d items in %s.`, n, ns.Name)
+	return nil
+}
+
+// segment is where log segment n lives.
+func (ns *namespace) segment(n int) string {
+	return ns.file(fmt.Sprintf(`.log.%d`, n))
+}
+
+// segments lists the numbers of the log segments on disk, oldest first.
+func (ns *namespace) segments() []int {
+	files, _ := filepath.Glob(ns.file(`.log.*`))
+	var segs []int
+	for _, f := range files {
+		if n, err := strconv.Atoi(strings.TrimPrefix(f, ns.file(`.log.`))); err == nil {
+			segs = append(segs, n)
+		}
+	}
+	sort.Ints(segs)
+	return segs
+}
+
+// persist compacts the namespace's log once it has grown enough, or at once
+// if writing it failed.
+func (ns *namespace) persist() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.dropped {
+		return
+	}
+	if size := ns.log.size(); ns.log.broken() || size > compactMin && size > ns.snapSize {
+		ns.compact()
+	}
+}
+
+// compact starts a new log segment and writes a snapshot, then drops the
+// older segments. Until then, the old snapshot or, once it is written, the
+// new one, and every segment still replay to the current contents: a
+// segment cut short by a failed write is followed by one recording anew
+// the changes it misses. ns.mu must be held.
+func (ns *namespace) compact() {
+	if err := ns.rotate(); err != nil {
+		log.Printf(`[ERROR] Unable to start a new log for %s: %v`, ns.Name, err)
+		return
+	}
+	if err := ns.snapshot(); err != nil {
+		log.Printf(`[ERROR] Unable to persist %s: %v`, ns.Name, err)
+		return
+	}
+	ns.trim()
+}
+
+// rotate starts logging to a new segment. ns.mu must be held.
+func (ns *namespace) rotate() error {
+	l, err := openLog(ns.segment(ns.seg + 1))
+	if err != nil {
+		return err
+	}
+	ns.seg++
+	ns.disk.Journal(l)
+	if ns.log != nil {
+		ns.log.close()
+	}
+	ns.log = l
+	return syncDir(filepath.Dir(ns.segment(ns.seg)))
+}
+
+// trim removes the segments older than the one being written, which the
+// last snapshot makes redundant. ns.mu must be held.
+func (ns *namespace) trim() {
+	for _, n := range ns.segments() {
+		if n >= ns.seg {
+			continue
+		}
+		if err := os.Remove(ns.segment(n)); err != nil {
+			log.Printf(`[ERROR] Unable to remove log of %s: %v`, ns.Name, err)
+		}
+	}
+}
+
+// unpersist restores the namespace from its snapshot and log segments,
+// starts logging to a new segment and writes it back as a fresh snapshot.
+func (ns *namespace) unpersist() error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	gen, err := readGeneration(ns.file(`.dat`), *snapshots, func(b []byte) error {
+		return ns.disk.Load(bytes.NewReader(b))
+	})
+	if gen < 0 && err != nil {
+		// Starting empty would soon rotate the snapshots that are there
+		// out of existence.
+		return fmt.Errorf(`no snapshot could be read, last %v; move them out of the way to start empty`, err)
+	} else if err != nil {
+		log.Printf("[ERROR] Unable to unpersist %s: %v\n", ns.Name, err)
+	}
+	if gen > 0 {
+		// The logs only go back to the newest snapshot, so whatever
+		// changed between the two is lost.
+		log.Printf(`[ERROR] Recovered %s from snapshot generation %d; recent changes may be lost.`, ns.Name, gen)
+	}
+	for _, n := range ns.segments() {
+		f, err := os.Open(ns.segment(n))
+		if err != nil {
+			return err
+		}
+		// A crash or failed write may have cut the last batch short;
+		// the rest stands.
+		r, err := ns.disk.Replay(f)
+		f.Close()
+		if err != nil {
+			log.Printf(`[ERROR] Unable to replay all of %s: %v`, ns.segment(n), err)
+		}
+		log.Printf(`Replayed %d changes to %s.`, r, ns.Name)
+		ns.seg = n
+	}
+	if err := ns.rotate(); err != nil {
+		return err
+	}
+	if err := ns.snapshot(); err != nil {
+		return err
+	}
+	ns.trim()
+	return nil
+}
+
+// sync syncs the namespace's log to disk.
+func (ns *namespace) sync() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if !ns.dropped {
+		ns.log.sync()
+	}
+}
+
+// close compacts the namespace on shutdown, so the next start has no log to
+// replay, and stops logging.
+func (ns *namespace) close() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.dropped {
+		return
+	}
+	if ns.log.size() > 0 || ns.log.broken() {
+		ns.compact()
+	}
+	ns.disk.Journal(nil)
+	ns.log.close()
+}
+
+// lookupNS returns the named namespace, or nil.
+func lookupNS(name string) *namespace {
+	nsLock.RLock()
+	defer nsLock.RUnlock()
+	return namespaces[name]
+}
+
+// allNS returns every namespace, sorted by name.
+func allNS() []*namespace {
+	nsLock.RLock()
+	all := make([]*namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		all = append(all, ns)
+	}
+	nsLock.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// writeManifest records the namespace settings so loadNamespaces can bring
+// them back. nsLock must not be held.
+func writeManifest() {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+	nsLock.RLock()
+	all := make([]*namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if ns.Name != defaultNS {
+			all = append(all, ns)
+		}
+	}
+	b, _ := json.Marshal(all)
+	nsLock.RUnlock()
+	if err := writeAtomic(dataFile(`kirkwood.ns.json`), b, 1); err != nil {
+		log.Printf(`[ERROR] Unable to write namespace manifest: %v`, err)
+	}
+}
+
+// loadNamespaces sets up the default namespace and those in the manifest,
+// and restores their contents.
+func loadNamespaces() {
+	namespaces = map[string]*namespace{
+		defaultNS: newNamespace(&namespace{Name: defaultNS}),
+	}
+	if b, err := ioutil.ReadFile(dataFile(`kirkwood.ns.json`)); err == nil {
+		var all []*namespace
+		if err = json.Unmarshal(b, &all); err != nil {
+			log.Printf("[ERROR] Unable to read namespace manifest: %v\n", err)
+		}
+		for _, ns := range all {
+			namespaces[ns.Name] = newNamespace(ns)
+		}
+	}
+	for _, ns := range namespaces {
+		if err := ns.unpersist(); err != nil {
+			log.Fatalf(`Unable to restore %s: %v`, ns.Name, err)
+		}
+	}
+}
+
+func createNS(ns *namespace) int {
+	if !reserveNS(ns.Name) {
+		return 409
+	}
+	defer releaseNS(ns.Name)
+	if err := newNamespace(ns).unpersist(); err != nil {
+		log.Printf(`[ERROR] Unable to persist %s: %v`, ns.Name, err)
+		return 500
+	}
+	nsLock.Lock()
+	namespaces[ns.Name] = ns
+	nsLock.Unlock()
+	writeManifest()
+	return 201
+}
+
+func dropNS(name string) int {
+	nsLock.Lock()
+	ns, found := namespaces[name]
+	switch {
+	case !found:
+		nsLock.Unlock()
+		return 404
+	case name == defaultNS:
+		nsLock.Unlock()
+		return 409
+	}
+	delete(namespaces, name)
+	nsBusy[name] = true
+	nsLock.Unlock()
+	defer releaseNS(name)
+	writeManifest()
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.dropped = true
+	ns.disk.Journal(nil)
+	ns.log.close()
+	files, _ := filepath.Glob(ns.file(`.dat*`))
+	logs, _ := filepath.Glob(ns.file(`.log*`))
+	for _, f := range append(files, logs...) {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			log.Printf(`[ERROR] Unable to remove persist file: %v`, err)
+		}
+	}
+	return 204
+}
+
+// reserveNS claims a name no namespace has, nor is being created or dropped
+// under, reporting whether it could.
+func reserveNS(name string) bool {
+	nsLock.Lock()
+	defer nsLock.Unlock()
+	if _, found := namespaces[name]; found || nsBusy[name] {
+		return false
+	}
+	nsBusy[name] = true
+	return true
+}
+
+// releaseNS lets go of a name claimed by reserveNS or dropNS.
+func releaseNS(name string) {
+	nsLock.Lock()
+	delete(nsBusy, name)
+	nsLock.Unlock()
+}
+
+// nsHandler serves /ns/ (list and create), /ns/{name} (describe and drop)
+// and hands /ns/{name}/cache/..., /ns/{name}/tags/... and
+// /ns/{name}/tombstones/ over to their handlers.
+func nsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	path := r.URL.EscapedPath()[len(nsPrefix):]
+	name, rest := path, ``
+	if i := strings.Index(path, `/`); i >= 0 {
+		name, rest = path[:i], path[i:]
+	}
+
+	if rest != `` {
+		ns := lookupNS(name)
+		switch {
+		case ns == nil:
+			w.WriteHeader(404)
+		case strings.HasPrefix(rest, prefix):
+			serveCache(w, r, ns, rest[plen:])
+		case strings.HasPrefix(rest, tagPrefix):
+			serveTags(w, r, ns, rest[len(tagPrefix):])
+		case rest == tombPrefix:
+			serveTombstones(w, r, ns)
+		default:
+			w.WriteHeader(404)
+		}
+		return
+	}
+
+	var (
+		ret int
+		s   interface{}
+	)
+	switch {
+	case name == `` && r.Method == `GET`:
+		all := allNS()
+		names := make([]string, len(all))
+		for i, ns := range all {
+			names[i] = ns.Name
+		}
+		s, ret = map[string][]string{`namespaces`: names}, 200
+	case name == `` && r.Method == `POST`:
+		ns := &namespace{}
+		if body, err := readBody(w, r, *maxBody); err != nil {
+			if err, ok := err.(*sizeError); ok {
+				writeTooLarge(w, err)
+				return
+			}
+			ret = 406
+		} else if err = json.Unmarshal(body, ns); err != nil || !nsName.MatchString(ns.Name) ||
+			ns.MaxItems < 0 || ns.MaxBytes < 0 || ns.MaxBody < 0 || ns.MaxKey < 0 || ns.MaxValue < 0 {
+			ret = 406
+		} else if ret = createNS(ns); ret == 201 {
+			w.Header().Add(`Location`, ns.prefix())
+		}
+	case name != `` && r.Method == `GET`:
+		if ns := lookupNS(name); ns != nil {
+			s, ret = nsInfo{ns, ns.store.Stats()}, 200
+		} else {
+			ret = 404
+		}
+	case name != `` && r.Method == `DELETE`:
+		ret = dropNS(name)
+	default:
+		ret = 405
+	}
+
+	w.WriteHeader(ret)
+	if s != nil {
+		body, _ := json.Marshal(s)
+		w.Write(body)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	`encoding/json`
+	`net/http`
+	`net/url`
+)
+
+var tagPrefix string = `/tags/`
+
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	serveTags(w, r, lookupNS(defaultNS), r.URL.EscapedPath()[len(tagPrefix):])
+}
+
+// serveTags serves /tags/{tag} from the namespace ns: GET lists the items
+// tagged tag, DELETE removes them all.
+func serveTags(w http.ResponseWriter, r *http.Request, ns *namespace, path string) {
+	tag, err := url.PathUnescape(path)
+	if err != nil || tag == `` {
+		w.WriteHeader(404)
+		return
+	}
+	switch r.Method {
+	case `GET`:
+		body, _ := json.Marshal(flatCache{Elts: ns.store.Tagged(tag)})
+		w.Write(body)
+	case `DELETE`:
+		if ns.store.DeleteTagged(tag) > 0 {
+			w.WriteHeader(204)
+		} else {
+			w.WriteHeader(404)
+		}
+	default:
+		w.WriteHeader(405)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	`encoding/json`
+	`net/http`
+	`time`
+)
+
+var tombPrefix string = `/tombstones/`
+
+// tombstone describes a deleted item that can still be undeleted.
+type tombstone struct {
+	cacheElt
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+func tombstonesHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.URL.Path != tombPrefix {
+		w.WriteHeader(404)
+		return
+	}
+	serveTombstones(w, r, lookupNS(defaultNS))
+}
+
+// serveTombstones serves GET /tombstones/: the deleted items of ns that can
+// still be undeleted, most recently deleted first.
+func serveTombstones(w http.ResponseWriter, r *http.Request, ns *namespace) {
+	if r.Method != `GET` {
+		w.WriteHeader(405)
+		return
+	}
+	ts := ns.store.Tombstones()
+	out := make([]tombstone, len(ts))
+	for i, t := range ts {
+		out[i] = tombstone{t.Elt, t.Deleted, t.Deleted.Add(*retention)}
+	}
+	body, _ := json.Marshal(map[string][]tombstone{`tombstones`: out})
+	w.Write(body)
+}